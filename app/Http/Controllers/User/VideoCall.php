@@ -0,0 +1,94 @@
+<?php
+
+namespace App\Http\Controllers\User;
+
+use App\Http\Controllers\Controller;
+use App\Models\Lesson;
+use App\Services\SfuTokenService;
+use Illuminate\Http\Request;
+use Illuminate\Support\Carbon;
+
+class VideoCall extends Controller {
+
+  public function token(Lesson $lesson, SfuTokenService $tokens) {
+    if (!config('services.sfu.token_secret')) {
+      return response()->json(['message' => 'Video call tokens are not configured'], 503);
+    }
+
+    $user = request()->user();
+    $role = $tokens->roleFor($user, $lesson);
+
+    if (!$role) {
+      return response()->json(['message' => 'Forbidden'], 403);
+    }
+
+    return response()->json($tokens->mint($user, $lesson, $role));
+  }
+
+  /**
+   * Used by the SFU (sanctum auth mode) to resolve a personal access token
+   * and the facts it needs to decide whether the user may join the lesson.
+   */
+  public function introspect(Lesson $lesson) {
+    $user = request()->user();
+
+    return response()->json([
+      'user' => [
+        'id' => (int) $user->id,
+        'name' => trim($user->name . ' ' . $user->last_name),
+        'role' => $user->role,
+      ],
+      'lesson' => [
+        'id' => (int) $lesson->id,
+        'professor_id' => (int) $lesson->course?->professor_id,
+      ],
+      'purchased' => $lesson->purchases()
+        ->where('student_id', $user->id)
+        ->where('status', 'active')
+        ->exists(),
+    ]);
+  }
+
+  /**
+   * Receives the chat log the SFU exports when the lesson's room closes.
+   * There is no user here: the SFU signs the body with the export secret.
+   */
+  public function chatLog(Request $request, Lesson $lesson, SfuTokenService $tokens) {
+    if (!config('services.sfu.export_secret')) {
+      return response()->json(['message' => 'Chat log export is not configured'], 503);
+    }
+
+    $signed = $tokens->verifySignature(
+      $request->getContent(),
+      $request->header('X-SFU-Timestamp'),
+      $request->header('X-SFU-Signature'),
+    );
+    if (!$signed) {
+      return response()->json(['message' => 'Invalid signature'], 401);
+    }
+
+    $data = $request->validate([
+      'sessionId' => 'required|string',
+      'startedAt' => 'required|date',
+      'closedAt' => 'required|date',
+      'messages' => 'present|array',
+      'dropped' => 'sometimes|integer|min:0',
+    ]);
+
+    if ($data['sessionId'] !== (string) $lesson->id) {
+      return response()->json(['message' => 'The session is not this lesson'], 422);
+    }
+
+    $timezone = config('app.timezone');
+    $log = $lesson->chatLogs()->updateOrCreate(
+      ['started_at' => Carbon::parse($data['startedAt'])->setTimezone($timezone)->startOfSecond()],
+      [
+        'closed_at' => Carbon::parse($data['closedAt'])->setTimezone($timezone),
+        'messages' => $data['messages'],
+        'dropped' => $data['dropped'] ?? 0,
+      ],
+    );
+
+    return response()->json(['id' => $log->id], 201);
+  }
+}
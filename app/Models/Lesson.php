@@ -28,6 +28,11 @@ public function purchases() {
         return $this->hasMany(Purchase::class, 'lesson_id');
     }
 
+    /** Chat logs exported by the SFU, one per opening of the lesson's room */
+    public function chatLogs() {
+        return $this->hasMany(LessonChatLog::class, 'lesson_id');
+    }
+
     public function rating() {
         return DB::table('ratings')
             ->join('lessons', 'ratings.lesson_id', '=', 'lessons.id')
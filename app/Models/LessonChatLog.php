@@ -0,0 +1,27 @@
+<?php
+
+namespace App\Models;
+
+use Illuminate\Database\Eloquent\Model;
+
+class LessonChatLog extends Model {
+
+    protected $fillable = [
+        'started_at',
+        'closed_at',
+        'messages',
+        'dropped',
+    ];
+
+    protected function casts(): array {
+        return [
+            'started_at' => 'datetime',
+            'closed_at' => 'datetime',
+            'messages' => 'array',
+        ];
+    }
+
+    public function lesson() {
+        return $this->belongsTo(Lesson::class, 'lesson_id');
+    }
+}
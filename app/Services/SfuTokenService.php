@@ -0,0 +1,83 @@
+<?php
+
+namespace App\Services;
+
+use App\Models\Lesson;
+use App\Models\User;
+use Illuminate\Support\Carbon;
+
+class SfuTokenService {
+
+  /** How old (in seconds) a request signed by the SFU may be. */
+  private const SIGNATURE_TOLERANCE = 300;
+
+  /**
+   * Participant role for $user in $lesson, or null when the user may not attend.
+   */
+  public function roleFor(User $user, Lesson $lesson): ?string {
+    if ($user->role === 'administrator') {
+      return 'host';
+    }
+
+    if ($lesson->course && $lesson->course->professor_id == $user->id) {
+      return 'host';
+    }
+
+    $purchased = $lesson->purchases()
+      ->where('student_id', $user->id)
+      ->where('status', 'active')
+      ->exists();
+
+    return $purchased ? 'student' : null;
+  }
+
+  /**
+   * Mint a short-lived HS256 join token verified by the SFU with the shared secret.
+   */
+  public function mint(User $user, Lesson $lesson, string $role): array {
+    $now = time();
+    $expiresAt = $now + (int) config('services.sfu.token_ttl', 60);
+
+    $header = ['alg' => 'HS256', 'typ' => 'JWT'];
+    $claims = [
+      'sub'  => (string) $user->id,
+      'name' => trim($user->name . ' ' . $user->last_name),
+      'role' => $role,
+      'sid'  => (string) $lesson->id,
+      'end'  => Carbon::parse($lesson->date)->addMinutes((int) config('services.sfu.lesson_duration', 120))->timestamp,
+      'iat'  => $now,
+      'nbf'  => $now,
+      'exp'  => $expiresAt,
+    ];
+
+    $input = $this->encode(json_encode($header)) . '.' . $this->encode(json_encode($claims));
+    $signature = hash_hmac('sha256', $input, config('services.sfu.token_secret'), true);
+
+    return [
+      'token' => $input . '.' . $this->encode($signature),
+      'expires_at' => $expiresAt,
+    ];
+  }
+
+  /**
+   * Check a chat log export signed by the SFU with the export secret (never
+   * the join token one): $signature is the hex HMAC-SHA256 of
+   * "<timestamp>.<body>".
+   */
+  public function verifySignature(string $body, ?string $timestamp, ?string $signature): bool {
+    $secret = config('services.sfu.export_secret');
+    if (!$secret || !$signature || !$timestamp || !ctype_digit($timestamp)) {
+      return false;
+    }
+
+    if (abs(time() - (int) $timestamp) > self::SIGNATURE_TOLERANCE) {
+      return false;
+    }
+
+    return hash_equals(hash_hmac('sha256', $timestamp . '.' . $body, $secret), $signature);
+  }
+
+  private function encode(string $data): string {
+    return rtrim(strtr(base64_encode($data), '+/', '-_'), '=');
+  }
+}
@@ -1,55 +1,77 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"log"
 	"net/http"
 	"os"
-	"time"
+	"strconv"
 
 	"webrtc-sfu/sfu"
 )
 
 func main() {
-	server := sfu.NewServer()
+	cfg, err := sfu.LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("invalid configuration:\n%v", err)
+	}
+	log.Printf("configuration:\n%s", cfg.Redacted())
+
+	authorizer, err := sfu.NewAuthorizer(cfg.Auth)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tokens, err := sfu.NewTokenVerifier(cfg.Tokens)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tokens == nil {
+		log.Printf("Warning: JOIN_TOKEN_SECRET/JOIN_TOKEN_PUBLIC_KEY_FILE not set, trusting client-supplied identity")
+	}
+
+	if cfg.TURN.Enabled() {
+		if _, err := sfu.StartTURN(cfg.TURN, &cfg.Rooms.ICE); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	server := sfu.NewServer(cfg, authorizer, tokens)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ws", server.HandleWebSocket)
+	mux.HandleFunc("/whip/", server.HandleWHIP)
+	mux.HandleFunc("/whep/", server.HandleWHEP)
+	if hls := server.HLSHandler(); hls != nil {
+		mux.Handle("/hls/", hls)
+	}
 	mux.Handle("/", http.FileServer(http.Dir("./client")))
 
-	// Servidor HTTP en puerto 8080
-	httpAddr := ":8080"
-	if v := os.Getenv("HTTP_PORT"); v != "" {
-		httpAddr = ":" + v
-	}
+	// Servidor HTTP (8080 por defecto)
+	httpAddr := ":" + strconv.Itoa(cfg.HTTP.Port)
 
 	httpServer := &http.Server{
 		Addr:              httpAddr,
 		Handler:           mux,
-		ReadHeaderTimeout: 5 * time.Second,
+		ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout,
 	}
 
-	// Servidor HTTPS en puerto 8443
-	httpsAddr := ":8443"
-	if v := os.Getenv("HTTPS_PORT"); v != "" {
-		httpsAddr = ":" + v
-	}
+	// Servidor HTTPS (8443 por defecto)
+	httpsAddr := ":" + strconv.Itoa(cfg.HTTP.HTTPSPort)
 
 	httpsServer := &http.Server{
 		Addr:              httpsAddr,
 		Handler:           mux,
-		ReadHeaderTimeout: 5 * time.Second,
+		ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout,
 	}
 
 	// Certificados SSL
-	certFile := os.Getenv("CERT_FILE")
-	keyFile := os.Getenv("KEY_FILE")
-
-	if certFile == "" {
-		certFile = "/etc/apache2/ssl/localhost.crt"
-	}
-	if keyFile == "" {
-		keyFile = "/etc/apache2/ssl/localhost.key"
-	}
+	certFile := cfg.HTTP.CertFile
+	keyFile := cfg.HTTP.KeyFile
 
 	// Iniciar servidor HTTP en goroutine
 	go func() {
@@ -0,0 +1,179 @@
+package sfu
+
+import (
+	"log"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Server-side voice activity detection. Browsers put the level of every
+// audio packet in the ssrc-audio-level header extension (RFC 6464, in -dBov:
+// 0 is the loudest, 127 silence). Each audio track counts the packets above
+// audioActiveLevel over a short window, smooths that ratio and flips its
+// publisher's `speaking` state with hysteresis. Peers whose audio carries
+// the extension ignore the client `speaking` reports, which remain the
+// fallback for the rest.
+const (
+	audioLevelURI      = "urn:ietf:params:rtp-hdrext:ssrc-audio-level"
+	audioLevelInterval = 200 * time.Millisecond
+	audioActiveLevel   = 40  // packets at -40 dBov or louder count as voice
+	audioSmoothing     = 0.4 // weight of the last window in the smoothed ratio
+	audioSpeakingOn    = 0.5 // smoothed ratio to start speaking
+	audioSpeakingOff   = 0.2 // and to stop
+	// dominantLevelMargin is how much louder (in smoothed ratio) another
+	// speaker must be to take the dominant spot from one who is speaking.
+	dominantLevelMargin = 0.2
+)
+
+// audioLevelDetector holds the voice activity state of an audio track.
+// It is protected by the PublishedTrack lock.
+type audioLevelDetector struct {
+	extensionID uint8
+	packets     int
+	active      int
+	smoothed    float64
+	speaking    bool
+}
+
+// audioLevelExtensionID returns the ID negotiated for the audio level
+// extension on receiver, or 0 if the client did not accept it.
+func audioLevelExtensionID(receiver *webrtc.RTPReceiver) uint8 {
+	if receiver == nil {
+		return 0
+	}
+	for _, ext := range receiver.GetParameters().HeaderExtensions {
+		if ext.URI == audioLevelURI {
+			return uint8(ext.ID)
+		}
+	}
+	return 0
+}
+
+func (d *audioLevelDetector) observe(pkt *rtp.Packet) {
+	payload := pkt.GetExtension(d.extensionID)
+	if payload == nil {
+		return
+	}
+	var level rtp.AudioLevelExtension
+	if err := level.Unmarshal(payload); err != nil {
+		return
+	}
+	d.packets++
+	if level.Level <= audioActiveLevel {
+		d.active++
+	}
+}
+
+// evaluate closes the current window. Without packets (DTX, muted) the
+// window counts as silence.
+func (d *audioLevelDetector) evaluate() (changed bool) {
+	ratio := 0.0
+	if d.packets > 0 {
+		ratio = float64(d.active) / float64(d.packets)
+	}
+	d.packets, d.active = 0, 0
+	d.smoothed = d.smoothed*(1-audioSmoothing) + ratio*audioSmoothing
+
+	switch {
+	case !d.speaking && d.smoothed >= audioSpeakingOn:
+		d.speaking = true
+		return true
+	case d.speaking && d.smoothed < audioSpeakingOff:
+		d.speaking = false
+		return true
+	}
+	return false
+}
+
+// detectSpeech runs the voice activity detection of an audio track until
+// the track stops.
+func (p *PublishedTrack) detectSpeech() {
+	publisher := p.publisher
+	publisher.stateMu.Lock()
+	publisher.serverVAD = true
+	publisher.stateMu.Unlock()
+
+	ticker := time.NewTicker(audioLevelInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.mu.Lock()
+			changed := p.audioLevel.evaluate()
+			speaking := p.audioLevel.speaking
+			level := p.audioLevel.smoothed
+			p.mu.Unlock()
+
+			if changed {
+				publisher.setSpeaking(speaking)
+			}
+			if speaking {
+				publisher.room.speakerLevel(publisher, level)
+			}
+		case <-p.done:
+			p.mu.Lock()
+			speaking := p.audioLevel.speaking
+			p.mu.Unlock()
+			if speaking {
+				publisher.setSpeaking(false)
+			}
+			return
+		}
+	}
+}
+
+// setSpeaking updates the speaking state of the peer and tells the room.
+func (p *Peer) setSpeaking(speaking bool) {
+	p.stateMu.Lock()
+	p.speaking = speaking
+	p.stateMu.Unlock()
+
+	if speaking {
+		p.room.SpeakerActive(p)
+	} else {
+		p.room.speakerLevel(p, 0)
+	}
+	// Broadcast to ALL peers including the originator
+	p.room.BroadcastToAll(Signal{
+		Type:     "speaking",
+		PeerID:   p.id,
+		UserID:   p.userID,
+		Speaking: speaking,
+	})
+}
+
+// usesServerVAD reports whether speech is detected from the peer's audio
+// levels, in which case its own `speaking` reports are ignored.
+func (p *Peer) usesServerVAD() bool {
+	p.stateMu.RLock()
+	defer p.stateMu.RUnlock()
+	return p.serverVAD
+}
+
+// speakerLevel records the smoothed voice activity of a speaking peer (0
+// when it stops) and hands it the dominant spot when it is clearly louder
+// than the current dominant speaker.
+func (r *Room) speakerLevel(peer *Peer, level float64) {
+	now := time.Now()
+
+	r.speakerMu.Lock()
+	if level > 0 {
+		r.levels[peer.id] = level
+	} else {
+		delete(r.levels, peer.id)
+	}
+	if r.dominant == peer.id || level == 0 || now.Sub(r.dominantAt) < dominantSpeakerHold || level < r.levels[r.dominant]+dominantLevelMargin {
+		r.speakerMu.Unlock()
+		return
+	}
+	r.dominant = peer.id
+	r.dominantAt = now
+	r.speakerMu.Unlock()
+
+	log.Printf("[ROOM %s] dominant speaker: %s", r.id, peer.id[:8])
+	r.BroadcastToAll(Signal{Type: "dominant_speaker", PeerID: peer.id, UserID: peer.userID})
+	r.refreshFollowers()
+}
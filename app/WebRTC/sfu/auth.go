@@ -2,58 +2,83 @@ package sfu
 
 import (
 	"context"
+	"fmt"
 	"log"
 )
 
-// AuthorizeUser checks if a user is authorized to join a session.
-// This function is designed to be implemented with database calls or external services.
-// For now, it always returns true, but it can be easily extended.
-//
-// Parameters:
-//   - ctx: context for cancellation and timeouts (important for DB calls)
-//   - userID: the user identifier
-//   - sessionID: the session identifier
-//
-// Returns:
-//   - bool: true if user is authorized, false otherwise
-//   - error: any error that occurred during authorization (DB connection, network, etc.)
-func AuthorizeUser(ctx context.Context, userID string, sessionID string) (bool, error) {
-	log.Printf("[AUTH] AuthorizeUser called: userID=%s sessionID=%s", userID, sessionID)
-
-	// Simulate async operation (in real implementation, this would call a database)
-	// You can add context timeout handling here for DB queries:
-	// select {
-	// case <-ctx.Done():
-	//     return false, ctx.Err()
-	// default:
-	// }
-
-	// TODO: Replace with actual authorization logic
-	// Example implementations:
-	//
-	// 1. Database query:
-	// rows, err := db.QueryContext(ctx, "SELECT authorized FROM sessions WHERE user_id = ? AND session_id = ?", userID, sessionID)
-	// if err != nil {
-	//     return false, err
-	// }
-	// var authorized bool
-	// if rows.Next() {
-	//     if err := rows.Scan(&authorized); err != nil {
-	//         return false, err
-	//     }
-	// }
-	// return authorized, nil
-	//
-	// 2. External HTTP service:
-	// req, _ := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://auth-service/check?user=%s&session=%s", userID, sessionID), nil)
-	// resp, err := http.DefaultClient.Do(req)
-	// if err != nil {
-	//     return false, err
-	// }
-	// defer resp.Body.Close()
-	// return resp.StatusCode == http.StatusOK, nil
-
-	// For now, always authorize
-	log.Printf("[AUTH] AuthorizeUser: authorized=%v", true)
-	return true, nil
+// AuthRequest carries what the server knows about a joining user.
+type AuthRequest struct {
+	UserID      string
+	SessionID   string
+	AccessToken string // Laravel Sanctum personal access token, if the client sent one
+}
+
+// AuthResult is the outcome of an authorization check. Authorizers that
+// resolve the user themselves (e.g. from an access token) fill in UserID,
+// UserName and Role, which then take precedence over the join parameters.
+type AuthResult struct {
+	Authorized bool
+	UserID     string
+	UserName   string
+	Role       string
+}
+
+// Authorizer decides whether a user is allowed to join a session.
+// Implementations may hit a database or an external service, so they must
+// honour ctx for cancellation and timeouts. A non-nil error means the
+// decision could not be made (DB connection, network, etc.).
+type Authorizer interface {
+	Authorize(ctx context.Context, req AuthRequest) (AuthResult, error)
+}
+
+// Authorization modes accepted by NewAuthorizer.
+const (
+	AuthModeAllowAll = "allow_all"
+	AuthModeStatic   = "static"
+	AuthModeHTTP     = "http"
+	AuthModeSanctum  = "sanctum"
+)
+
+// AuthConfig selects and configures the Authorizer used by the server.
+type AuthConfig struct {
+	Mode          string `yaml:"mode" env:"AUTH_MODE"`                    // allow_all (default), static, http or sanctum
+	AllowlistFile string `yaml:"allowlistFile" env:"AUTH_ALLOWLIST_FILE"` // JSON allowlist used by the static mode
+	URL           string `yaml:"url" env:"AUTH_URL"`                      // callback endpoint used by the http mode
+	// IntrospectionURL is the Laravel endpoint used by the sanctum mode.
+	// A "{session}" placeholder is replaced with the session ID.
+	IntrospectionURL string `yaml:"introspectionUrl" env:"AUTH_INTROSPECTION_URL"`
+}
+
+// NewAuthorizer builds the Authorizer described by cfg.
+func NewAuthorizer(cfg AuthConfig) (Authorizer, error) {
+	switch cfg.Mode {
+	case "", AuthModeAllowAll:
+		log.Printf("[AUTH] using allow-all authorizer (development only)")
+		return AllowAllAuthorizer{}, nil
+	case AuthModeStatic:
+		if cfg.AllowlistFile == "" {
+			return nil, fmt.Errorf("auth mode %q requires an allowlist file", cfg.Mode)
+		}
+		return NewStaticAuthorizer(cfg.AllowlistFile)
+	case AuthModeHTTP:
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("auth mode %q requires a callback url", cfg.Mode)
+		}
+		return NewHTTPAuthorizer(cfg.URL), nil
+	case AuthModeSanctum:
+		if cfg.IntrospectionURL == "" {
+			return nil, fmt.Errorf("auth mode %q requires an introspection url", cfg.Mode)
+		}
+		return NewSanctumAuthorizer(cfg.IntrospectionURL), nil
+	default:
+		return nil, fmt.Errorf("unknown auth mode %q", cfg.Mode)
+	}
+}
+
+// AllowAllAuthorizer lets everybody in. Only meant for local development.
+type AllowAllAuthorizer struct{}
+
+func (AllowAllAuthorizer) Authorize(ctx context.Context, req AuthRequest) (AuthResult, error) {
+	log.Printf("[AUTH] allow-all: userID=%s sessionID=%s authorized=true", req.UserID, req.SessionID)
+	return AuthResult{Authorized: true}, nil
 }
@@ -0,0 +1,62 @@
+package sfu
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// HTTPAuthorizer delegates the decision to an external service. It POSTs
+// {"userId": ..., "sessionId": ...} to the callback URL:
+//   - 2xx: authorized
+//   - 401, 403 or 404: denied
+//   - anything else: treated as an authorization error
+type HTTPAuthorizer struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTPAuthorizer(url string) *HTTPAuthorizer {
+	return &HTTPAuthorizer{url: url, client: http.DefaultClient}
+}
+
+type authCallbackRequest struct {
+	UserID    string `json:"userId"`
+	SessionID string `json:"sessionId"`
+}
+
+func (a *HTTPAuthorizer) Authorize(ctx context.Context, req AuthRequest) (AuthResult, error) {
+	body, err := json.Marshal(authCallbackRequest{UserID: req.UserID, SessionID: req.SessionID})
+	if err != nil {
+		return AuthResult{}, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return AuthResult{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "application/json")
+
+	resp, err := a.client.Do(httpReq)
+	if err != nil {
+		return AuthResult{}, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		log.Printf("[AUTH] http: userID=%s sessionID=%s authorized=true", req.UserID, req.SessionID)
+		return AuthResult{Authorized: true}, nil
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden, resp.StatusCode == http.StatusNotFound:
+		log.Printf("[AUTH] http: userID=%s sessionID=%s authorized=false status=%d", req.UserID, req.SessionID, resp.StatusCode)
+		return AuthResult{}, nil
+	default:
+		return AuthResult{}, fmt.Errorf("auth callback returned status %d", resp.StatusCode)
+	}
+}
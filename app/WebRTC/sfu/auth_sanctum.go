@@ -0,0 +1,95 @@
+package sfu
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// SanctumAuthorizer checks a Laravel Sanctum personal access token against
+// the application's introspection endpoint and applies the lesson rules:
+// the course professor and administrators join as hosts, students need a
+// purchase for the lesson, everybody else is denied.
+type SanctumAuthorizer struct {
+	url    string
+	client *http.Client
+}
+
+func NewSanctumAuthorizer(introspectionURL string) *SanctumAuthorizer {
+	return &SanctumAuthorizer{url: introspectionURL, client: http.DefaultClient}
+}
+
+// sanctumIntrospection mirrors the JSON returned by
+// GET /api/video-call/{lesson}/introspect in the Laravel application.
+type sanctumIntrospection struct {
+	User struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+		Role string `json:"role"`
+	} `json:"user"`
+	Lesson struct {
+		ID          int64 `json:"id"`
+		ProfessorID int64 `json:"professor_id"`
+	} `json:"lesson"`
+	Purchased bool `json:"purchased"`
+}
+
+func (a *SanctumAuthorizer) Authorize(ctx context.Context, req AuthRequest) (AuthResult, error) {
+	if req.AccessToken == "" {
+		log.Printf("[AUTH] sanctum: sessionID=%s denied, no access token", req.SessionID)
+		return AuthResult{}, nil
+	}
+
+	endpoint := strings.ReplaceAll(a.url, "{session}", url.PathEscape(req.SessionID))
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return AuthResult{}, err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+req.AccessToken)
+	httpReq.Header.Set("Accept", "application/json")
+
+	resp, err := a.client.Do(httpReq)
+	if err != nil {
+		return AuthResult{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		log.Printf("[AUTH] sanctum: sessionID=%s denied status=%d", req.SessionID, resp.StatusCode)
+		return AuthResult{}, nil
+	default:
+		return AuthResult{}, fmt.Errorf("introspection returned status %d", resp.StatusCode)
+	}
+
+	var info sanctumIntrospection
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&info); err != nil {
+		return AuthResult{}, fmt.Errorf("decode introspection: %w", err)
+	}
+	if info.User.ID == 0 {
+		return AuthResult{}, fmt.Errorf("introspection response without user")
+	}
+
+	result := AuthResult{
+		UserID:   strconv.FormatInt(info.User.ID, 10),
+		UserName: info.User.Name,
+	}
+	switch {
+	case info.User.Role == "administrator":
+		result.Authorized, result.Role = true, "host"
+	case info.Lesson.ProfessorID == info.User.ID:
+		result.Authorized, result.Role = true, "host"
+	case info.Purchased:
+		result.Authorized, result.Role = true, "student"
+	}
+
+	log.Printf("[AUTH] sanctum: userID=%s sessionID=%s authorized=%v role=%s", result.UserID, req.SessionID, result.Authorized, result.Role)
+	return result, nil
+}
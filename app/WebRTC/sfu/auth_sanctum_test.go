@@ -0,0 +1,106 @@
+package sfu
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeIntrospection stands in for GET /api/video-call/{lesson}/introspect:
+// each access token gets a canned status and body.
+func fakeIntrospection(t *testing.T, release <-chan struct{}) *httptest.Server {
+	responses := map[string]struct {
+		status int
+		body   string
+	}{
+		"professor":       {http.StatusOK, `{"user":{"id":7,"name":"Prof","role":"professor"},"lesson":{"id":1,"professor_id":7},"purchased":false}`},
+		"other-professor": {http.StatusOK, `{"user":{"id":8,"name":"Other","role":"professor"},"lesson":{"id":1,"professor_id":7},"purchased":false}`},
+		"admin":           {http.StatusOK, `{"user":{"id":1,"name":"Admin","role":"administrator"},"lesson":{"id":1,"professor_id":7},"purchased":false}`},
+		"buyer":           {http.StatusOK, `{"user":{"id":42,"name":"Alice","role":"student"},"lesson":{"id":1,"professor_id":7},"purchased":true}`},
+		"no-buyer":        {http.StatusOK, `{"user":{"id":43,"name":"Bob","role":"student"},"lesson":{"id":1,"professor_id":7},"purchased":false}`},
+		"revoked":         {http.StatusUnauthorized, `{"message":"Unauthenticated."}`},
+		"broken":          {http.StatusInternalServerError, `{}`},
+		"no-user":         {http.StatusOK, `{"lesson":{"id":1,"professor_id":7}}`},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/video-call/1/introspect" {
+			http.NotFound(w, r)
+			return
+		}
+		token := r.Header.Get("Authorization")
+		if token == "Bearer slow" {
+			<-release
+			return
+		}
+		response, ok := responses[token[len("Bearer "):]]
+		if !ok {
+			http.Error(w, "unknown token", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(response.status)
+		fmt.Fprint(w, response.body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSanctumAuthorizer(t *testing.T) {
+	release := make(chan struct{})
+	introspection := fakeIntrospection(t, release)
+	defer close(release)
+
+	cfg := DefaultConfig()
+	cfg.Signaling.AuthTimeout = 200 * time.Millisecond
+	s := &Server{
+		cfg:        cfg,
+		authorizer: NewSanctumAuthorizer(introspection.URL + "/api/video-call/{session}/introspect"),
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		session  string
+		role     Role
+		userID   string
+		userName string
+		err      error
+	}{
+		{name: "course professor", token: "professor", role: RoleHost, userID: "7", userName: "Prof"},
+		{name: "administrator", token: "admin", role: RoleHost, userID: "1", userName: "Admin"},
+		{name: "student with purchase", token: "buyer", role: RoleStudent, userID: "42", userName: "Alice"},
+		{name: "student without purchase", token: "no-buyer", err: errAccessDenied},
+		{name: "professor of another course", token: "other-professor", err: errAccessDenied},
+		{name: "no access token", token: "", err: errAccessDenied},
+		{name: "unauthenticated", token: "revoked", err: errAccessDenied},
+		{name: "unknown lesson", token: "buyer", session: "2", err: errAccessDenied},
+		{name: "server error", token: "broken", err: errAuthorizationFailed},
+		{name: "response without user", token: "no-user", err: errAuthorizationFailed},
+		{name: "timeout", token: "slow", err: errAuthorizationFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := tt.session
+			if session == "" {
+				session = "1"
+			}
+			// Without join tokens the client-supplied identity is replaced
+			// by the one of the access token
+			join := Signal{SessionID: session, UserID: "spoofed", AccessToken: tt.token}
+			role, _, err := s.identify(&join)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if role != tt.role || join.UserID != tt.userID || join.UserName != tt.userName {
+				t.Fatalf("got role=%s user=%s name=%s, want role=%s user=%s name=%s",
+					role, join.UserID, join.UserName, tt.role, tt.userID, tt.userName)
+			}
+		})
+	}
+}
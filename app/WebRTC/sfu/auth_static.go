@@ -0,0 +1,64 @@
+package sfu
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+// allowlistWildcard matches any session (as a key) or any user (as an entry).
+const allowlistWildcard = "*"
+
+// StaticAuthorizer authorizes users against an allowlist loaded from a JSON
+// file mapping session IDs to the user IDs allowed in them:
+//
+//	{
+//	    "lesson-42": ["17", "23"],
+//	    "*": ["1"]
+//	}
+//
+// The "*" session applies to every session and a "*" user allows everybody.
+type StaticAuthorizer struct {
+	sessions map[string]map[string]bool
+}
+
+func NewStaticAuthorizer(path string) (*StaticAuthorizer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read allowlist: %w", err)
+	}
+
+	var raw map[string][]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse allowlist %s: %w", path, err)
+	}
+
+	sessions := make(map[string]map[string]bool, len(raw))
+	for sessionID, users := range raw {
+		allowed := make(map[string]bool, len(users))
+		for _, userID := range users {
+			allowed[userID] = true
+		}
+		sessions[sessionID] = allowed
+	}
+
+	log.Printf("[AUTH] static allowlist loaded from %s (%d sessions)", path, len(sessions))
+	return &StaticAuthorizer{sessions: sessions}, nil
+}
+
+func (a *StaticAuthorizer) Authorize(ctx context.Context, req AuthRequest) (AuthResult, error) {
+	if err := ctx.Err(); err != nil {
+		return AuthResult{}, err
+	}
+
+	authorized := a.allows(req.SessionID, req.UserID) || a.allows(allowlistWildcard, req.UserID)
+	log.Printf("[AUTH] static: userID=%s sessionID=%s authorized=%v", req.UserID, req.SessionID, authorized)
+	return AuthResult{Authorized: authorized}, nil
+}
+
+func (a *StaticAuthorizer) allows(sessionID string, userID string) bool {
+	allowed := a.sessions[sessionID]
+	return allowed[userID] || allowed[allowlistWildcard]
+}
@@ -0,0 +1,286 @@
+package sfu
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Downlink bandwidth estimation. Browsers send feedback about what they
+// receive on the subPC: REMB (goog-remb), receiver reports and, when
+// negotiated, transport-wide congestion control. The estimate decides which
+// layer of each subscribed video is forwarded; when not even the lowest
+// layers fit, the videos with the lowest priority are paused.
+const (
+	bweInterval      = time.Second      // how often layers are re-allocated
+	bweStaleAfter    = 10 * time.Second // feedback older than this is ignored
+	bweMinBitrate    = 50_000
+	bweAudioBitrate  = 48_000 // reserved per audio track until measured
+	bweLossHigh      = 0.10   // above this the estimate goes down
+	bweLossLow       = 0.02   // below this it recovers
+	bweUpgradeMargin = 1.2    // headroom required before going up a layer
+	bweUpgradeHold   = 5 * time.Second
+)
+
+// bandwidthEstimator tracks the downlink of one subscriber and the layer
+// allocated to each of its subscriptions.
+type bandwidthEstimator struct {
+	mu          sync.Mutex
+	remb        uint64  // last REMB, 0 = none
+	lossBased   uint64  // loss-based estimate, 0 = loss is not limiting
+	loss        float64 // worst loss fraction since the last allocation
+	lossReports int
+	updatedAt   time.Time
+	sending     uint64 // bitrate of the current allocation
+
+	tracks       map[string]*PublishedTrack
+	allocation   map[string]int // quality level per track key, -1 = paused
+	downgradedAt time.Time      // upgrades wait bweUpgradeHold after a downgrade
+}
+
+func newBandwidthEstimator() *bandwidthEstimator {
+	return &bandwidthEstimator{
+		tracks:     map[string]*PublishedTrack{},
+		allocation: map[string]int{},
+	}
+}
+
+// add registers a subscription; hidden ones start paused.
+func (b *bandwidthEstimator) add(key string, pub *PublishedTrack, hidden bool) {
+	b.mu.Lock()
+	b.tracks[key] = pub
+	if hidden {
+		b.allocation[key] = -1
+	}
+	b.mu.Unlock()
+}
+
+func (b *bandwidthEstimator) remove(key string) {
+	b.mu.Lock()
+	delete(b.tracks, key)
+	delete(b.allocation, key)
+	b.mu.Unlock()
+}
+
+func (b *bandwidthEstimator) onREMB(bitrate uint64) {
+	b.mu.Lock()
+	b.remb = bitrate
+	b.updatedAt = time.Now()
+	b.mu.Unlock()
+}
+
+func (b *bandwidthEstimator) onLoss(fraction float64) {
+	b.mu.Lock()
+	if fraction > b.loss {
+		b.loss = fraction
+	}
+	b.lossReports++
+	b.updatedAt = time.Now()
+	b.mu.Unlock()
+}
+
+// estimateLocked folds the loss reports received since the last call into
+// the loss-based estimate and returns the current downlink estimate. ok is
+// false while there is no recent feedback.
+func (b *bandwidthEstimator) estimateLocked(now time.Time) (uint64, bool) {
+	if b.lossReports > 0 {
+		switch {
+		case b.loss > bweLossHigh:
+			base := b.sending
+			if b.lossBased != 0 && b.lossBased < base {
+				base = b.lossBased
+			}
+			if base == 0 {
+				break
+			}
+			b.lossBased = uint64(float64(base) * (1 - 0.5*b.loss))
+			if b.lossBased < bweMinBitrate {
+				b.lossBased = bweMinBitrate
+			}
+		case b.loss < bweLossLow && b.lossBased != 0:
+			b.lossBased = uint64(float64(b.lossBased) * 1.08)
+			if b.lossBased > 2*b.sending {
+				b.lossBased = 0
+			}
+		}
+		b.loss = 0
+		b.lossReports = 0
+	}
+
+	if b.updatedAt.IsZero() || now.Sub(b.updatedAt) > bweStaleAfter {
+		return 0, false
+	}
+	estimate := b.lossBased
+	if b.remb != 0 && (estimate == 0 || b.remb < estimate) {
+		estimate = b.remb
+	}
+	return estimate, estimate != 0
+}
+
+// subscriptionPriority orders videos when the downlink is short: screen
+// shares first, then the hosts' cameras, then everybody else.
+func subscriptionPriority(pub *PublishedTrack) int {
+	switch {
+	case pub.media == mediaScreen:
+		return 2
+	case pub.publisher != nil && pub.publisher.role == RoleHost:
+		return 1
+	}
+	return 0
+}
+
+type videoAllocation struct {
+	key     string
+	pub     *PublishedTrack
+	rates   []uint64 // bitrate of each quality level, lowest first
+	current int
+	level   int
+	hidden  bool // not forwarded because of last-N
+}
+
+func (p *Peer) allocateLoop() {
+	ticker := time.NewTicker(bweInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.allocateLayers()
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+// allocateLayers spends the estimated downlink on the subscribed videos:
+// audio is always forwarded, then every video gets its lowest level in
+// priority order (or is paused), then the remaining budget upgrades them.
+// Going down is immediate, going up needs headroom and bweUpgradeHold
+// since the last downgrade so layers do not flap. Videos hidden by last-N
+// are paused whatever the estimate.
+func (p *Peer) allocateLayers() {
+	b := p.bwe
+	now := time.Now()
+
+	b.mu.Lock()
+	estimate, known := b.estimateLocked(now)
+
+	var audio uint64
+	var hidden []*videoAllocation
+	videos := make([]*videoAllocation, 0, len(b.tracks))
+	for key, pub := range b.tracks {
+		rates := pub.Qualities(p.id)
+		if pub.media == mediaAudio {
+			if rates[0] > bweAudioBitrate {
+				audio += rates[0]
+			} else {
+				audio += bweAudioBitrate
+			}
+			continue
+		}
+		current, ok := b.allocation[key]
+		if !ok {
+			current = len(rates) - 1 // new subscriptions start uncapped
+		}
+		if current >= len(rates) {
+			current = len(rates) - 1
+		}
+		v := &videoAllocation{key: key, pub: pub, rates: rates, current: current, level: current}
+		if !p.room.forwardsVideo(p, pub) {
+			v.level = -1
+			v.hidden = true
+			hidden = append(hidden, v)
+			continue
+		}
+		videos = append(videos, v)
+	}
+
+	if known {
+		b.fitLocked(videos, estimate, audio, now)
+	} else {
+		// Without feedback visible videos are forwarded uncapped
+		for _, v := range videos {
+			if v.current < 0 {
+				v.level = len(v.rates) - 1
+			}
+		}
+	}
+
+	var paused, resumed []*PublishedTrack
+	b.sending = audio
+	for _, v := range append(videos, hidden...) {
+		if v.level >= 0 {
+			b.sending += v.rates[v.level]
+		}
+		previous, ok := b.allocation[v.key]
+		b.allocation[v.key] = v.level
+		if ok && previous == v.level {
+			continue
+		}
+		if v.level < v.current && !v.hidden {
+			b.downgradedAt = now
+		}
+		if v.level != v.current {
+			log.Printf("[PEER %s] bwe %d kbps: track %s level %d -> %d", p.id[:8], estimate/1000, v.key, v.current, v.level)
+		}
+		v.pub.SetSubscriberQuality(p.id, v.level)
+		switch {
+		case v.level < 0 && v.current >= 0:
+			paused = append(paused, v.pub)
+		case v.level >= 0 && v.current < 0:
+			resumed = append(resumed, v.pub)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, pub := range paused {
+		_ = p.Send(Signal{Type: "video_paused", PeerID: pub.publisherID, StreamID: pub.streamID})
+	}
+	for _, pub := range resumed {
+		_ = p.Send(Signal{Type: "video_resumed", PeerID: pub.publisherID, StreamID: pub.streamID})
+	}
+}
+
+// fitLocked picks the level of each visible video for the given estimate.
+func (b *bandwidthEstimator) fitLocked(videos []*videoAllocation, estimate uint64, audio uint64, now time.Time) {
+	sort.Slice(videos, func(i, j int) bool {
+		pi, pj := subscriptionPriority(videos[i].pub), subscriptionPriority(videos[j].pub)
+		if pi != pj {
+			return pi > pj
+		}
+		return videos[i].key < videos[j].key
+	})
+
+	canUpgrade := now.Sub(b.downgradedAt) >= bweUpgradeHold
+	fits := func(v *videoAllocation, level int, cost int64, budget int64) bool {
+		if level > v.current {
+			return canUpgrade && float64(cost)*bweUpgradeMargin <= float64(budget)
+		}
+		return cost <= budget
+	}
+
+	budget := int64(estimate) - int64(audio)
+	for _, v := range videos {
+		cost := int64(v.rates[0])
+		if fits(v, 0, cost, budget) {
+			v.level = 0
+			budget -= cost
+		} else {
+			v.level = -1
+		}
+	}
+	for _, v := range videos {
+		if v.level < 0 {
+			continue
+		}
+		for next := v.level + 1; next < len(v.rates); next++ {
+			cost := int64(v.rates[next]) - int64(v.rates[v.level])
+			if !fits(v, next, cost, budget) {
+				break
+			}
+			v.level = next
+			budget -= cost
+		}
+	}
+}
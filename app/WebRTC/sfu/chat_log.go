@@ -0,0 +1,230 @@
+package sfu
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChatConfig controls the chat log every room keeps of its chat and
+// reaction messages (see datachannel.go).
+type ChatConfig struct {
+	// Replay is how many recent messages late joiners receive in
+	// `chat_history` after `joined` (0 = none).
+	Replay int `yaml:"replay" env:"CHAT_REPLAY"`
+	// Dir keeps a JSON Lines copy of the log while the room is open, so
+	// that it survives a crash, and receives the export when it closes.
+	Dir string `yaml:"dir" env:"CHAT_DIR"`
+	// ExportURL receives the export as a JSON POST when the room closes.
+	// {session} is replaced with the session ID.
+	ExportURL string `yaml:"exportUrl" env:"CHAT_EXPORT_URL"`
+	// Secret signs the export, see chatSignature. It is its own secret,
+	// not the join token one, so that neither can be used for the other.
+	Secret string `yaml:"secret" env:"CHAT_EXPORT_SECRET" redact:"true"`
+}
+
+const (
+	chatMaxMessages   = 10000 // kept in memory, older ones are dropped
+	chatExportTimeout = 10 * time.Second
+
+	// The export POST carries the Unix time it was signed at and the
+	// hex HMAC-SHA256 of "<timestamp>.<body>".
+	chatTimestampHeader = "X-SFU-Timestamp"
+	chatSignatureHeader = "X-SFU-Signature"
+)
+
+// chatExport is what the Laravel side gets when a room closes.
+type chatExport struct {
+	SessionID string        `json:"sessionId"`
+	StartedAt time.Time     `json:"startedAt"`
+	ClosedAt  time.Time     `json:"closedAt"`
+	Messages  []DataMessage `json:"messages"`
+	// Dropped counts the oldest messages left out of Messages when the
+	// log outgrew memory; the JSON Lines file still has them.
+	Dropped int `json:"dropped,omitempty"`
+}
+
+type chatLog struct {
+	roomID    string
+	cfg       ChatConfig
+	startedAt time.Time
+
+	mu       sync.Mutex    // Protege: messages, head, dropped, file, closed
+	messages []DataMessage // ring of the last chatMaxMessages messages
+	head     int           // oldest message once the ring is full
+	dropped  int
+	file     *os.File // opened on the first message
+	closed   bool
+}
+
+func newChatLog(roomID string, cfg ChatConfig) *chatLog {
+	return &chatLog{roomID: roomID, cfg: cfg, startedAt: time.Now()}
+}
+
+// append adds msg; data is its JSON encoding.
+func (c *chatLog) append(msg DataMessage, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	if len(c.messages) < chatMaxMessages {
+		c.messages = append(c.messages, msg)
+	} else {
+		c.messages[c.head] = msg
+		c.head = (c.head + 1) % chatMaxMessages
+		c.dropped++
+	}
+
+	if c.cfg.Dir == "" {
+		return
+	}
+	if c.file == nil {
+		err := os.MkdirAll(c.cfg.Dir, 0o755)
+		var file *os.File
+		if err == nil {
+			file, err = os.OpenFile(c.filePath(".jsonl"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		}
+		if err != nil {
+			log.Printf("[ROOM %s] chat log: %v", c.roomID, err)
+			c.cfg.Dir = "" // keep going in memory only
+			return
+		}
+		c.file = file
+	}
+	if _, err := c.file.Write(append(data, '\n')); err != nil {
+		log.Printf("[ROOM %s] chat log: %v", c.roomID, err)
+	}
+}
+
+// recent returns the last n messages.
+func (c *chatLog) recent(n int) []DataMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if n <= 0 || len(c.messages) == 0 {
+		return nil
+	}
+	return c.lastLocked(n)
+}
+
+// lastLocked returns a copy of the last n messages, oldest first.
+func (c *chatLog) lastLocked(n int) []DataMessage {
+	total := len(c.messages)
+	if n > total {
+		n = total
+	}
+	last := make([]DataMessage, n)
+	for i := range last {
+		last[i] = c.messages[(c.head+total-n+i)%total]
+	}
+	return last
+}
+
+// close ends the log and exports it, if anything was said. The JSON Lines
+// file is removed once the export is written, unless it holds messages
+// the export lacks.
+func (c *chatLog) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+	if c.file != nil {
+		_ = c.file.Close()
+	}
+	if len(c.messages) == 0 {
+		return
+	}
+
+	export := chatExport{
+		SessionID: c.roomID,
+		StartedAt: c.startedAt,
+		ClosedAt:  time.Now(),
+		Messages:  c.lastLocked(len(c.messages)),
+		Dropped:   c.dropped,
+	}
+	data, err := json.Marshal(export)
+	if err != nil {
+		log.Printf("[ROOM %s] chat export: %v", c.roomID, err)
+		return
+	}
+	log.Printf("[ROOM %s] exporting chat log: %d messages", c.roomID, len(c.messages))
+
+	if c.cfg.Dir != "" {
+		// Write and rename so readers never see a half-written export
+		path := c.filePath(".json")
+		err := os.WriteFile(path+".tmp", data, 0o644)
+		if err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+		if err != nil {
+			log.Printf("[ROOM %s] chat export: %v", c.roomID, err)
+		} else if c.file != nil && c.dropped == 0 {
+			_ = os.Remove(c.file.Name())
+		}
+	}
+	if c.cfg.ExportURL != "" {
+		go c.post(data)
+	}
+}
+
+func (c *chatLog) post(data []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), chatExportTimeout)
+	defer cancel()
+
+	endpoint := strings.ReplaceAll(c.cfg.ExportURL, "{session}", url.PathEscape(c.roomID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		log.Printf("[ROOM %s] chat export: %v", c.roomID, err)
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set(chatTimestampHeader, timestamp)
+	req.Header.Set(chatSignatureHeader, chatSignature(c.cfg.Secret, timestamp, data))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("[ROOM %s] chat export: %v", c.roomID, err)
+		return
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Printf("[ROOM %s] chat export: status %d", c.roomID, resp.StatusCode)
+	}
+}
+
+// chatSignature signs an export for the Laravel side, which checks it with
+// the same ChatConfig.Secret. The timestamp keeps an old export from being
+// replayed.
+func chatSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (c *chatLog) filePath(ext string) string {
+	name := fmt.Sprintf("%s-%d%s", safeFileName(c.roomID), c.startedAt.Unix(), ext)
+	return filepath.Join(c.cfg.Dir, name)
+}
@@ -0,0 +1,83 @@
+package sfu
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestChatLogDropsOldest(t *testing.T) {
+	c := newChatLog("lesson-1", ChatConfig{})
+	total := chatMaxMessages + 5
+	for i := 0; i < total; i++ {
+		c.append(DataMessage{Type: "chat", ID: strconv.Itoa(i)}, nil)
+	}
+
+	recent := c.recent(3)
+	for i, msg := range recent {
+		if want := strconv.Itoa(total - 3 + i); msg.ID != want {
+			t.Fatalf("recent[%d] = %s, want %s", i, msg.ID, want)
+		}
+	}
+
+	c.mu.Lock()
+	all := c.lastLocked(len(c.messages))
+	dropped := c.dropped
+	c.mu.Unlock()
+	if len(all) != chatMaxMessages || dropped != 5 {
+		t.Fatalf("kept %d, dropped %d", len(all), dropped)
+	}
+	if all[0].ID != "5" || all[len(all)-1].ID != strconv.Itoa(total-1) {
+		t.Fatalf("kept %s..%s, want 5..%d", all[0].ID, all[len(all)-1].ID, total-1)
+	}
+}
+
+func TestChatLogExportIsSigned(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	laravel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer laravel.Close()
+
+	c := newChatLog("lesson 1", ChatConfig{ExportURL: laravel.URL + "/api/video-call/{session}/chat-log", Secret: "shared"})
+	c.append(DataMessage{Type: "chat", ID: "1", Text: "hola"}, nil)
+	c.close()
+
+	var r *http.Request
+	select {
+	case r = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no export posted")
+	}
+	body := <-bodies
+
+	if r.URL.EscapedPath() != "/api/video-call/lesson%201/chat-log" {
+		t.Errorf("posted to %s", r.URL.EscapedPath())
+	}
+	timestamp := r.Header.Get(chatTimestampHeader)
+	if at, err := strconv.ParseInt(timestamp, 10, 64); err != nil || time.Since(time.Unix(at, 0)) > time.Minute {
+		t.Errorf("timestamp %q", timestamp)
+	}
+	if got, want := r.Header.Get(chatSignatureHeader), chatSignature("shared", timestamp, body); got != want {
+		t.Errorf("signature %s, want %s", got, want)
+	}
+	if chatSignature("other", timestamp, body) == chatSignature("shared", timestamp, body) {
+		t.Error("signature does not depend on the secret")
+	}
+
+	var export chatExport
+	if err := json.Unmarshal(body, &export); err != nil {
+		t.Fatal(err)
+	}
+	if export.SessionID != "lesson 1" || len(export.Messages) != 1 || export.Messages[0].Text != "hola" {
+		t.Errorf("export %+v", export)
+	}
+}
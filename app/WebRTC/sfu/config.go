@@ -0,0 +1,185 @@
+package sfu
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"time"
+)
+
+// Config is the whole configuration of the SFU binary. LoadConfig fills
+// it from a YAML file, the environment and the command line (see
+// config_load.go): the yaml tag is the key in the file, the env tag the
+// environment variable, and fields tagged redact are hidden when the
+// configuration is printed.
+type Config struct {
+	HTTP      HTTPConfig      `yaml:"http"`
+	Signaling SignalingConfig `yaml:"signaling"`
+	Auth      AuthConfig      `yaml:"auth"`
+	Tokens    TokenConfig     `yaml:"tokens"`
+
+	// DefaultRole is given to participants whose authorizer did not assign
+	// one. It defaults to RoleStudent: a client that cannot prove it is a
+	// host never gets moderation rights. Join tokens always carry a role.
+	DefaultRole Role `yaml:"defaultRole" env:"DEFAULT_ROLE"`
+	// StudentsAudioOnly keeps students from publishing video until a host
+	// promotes them.
+	StudentsAudioOnly bool `yaml:"studentsAudioOnly" env:"STUDENTS_AUDIO_ONLY"`
+	// StudentsMuted keeps students from publishing audio unless a host
+	// calls on them from the hand-raise queue.
+	StudentsMuted bool       `yaml:"studentsMuted" env:"STUDENTS_MUTED"`
+	Rooms         RoomConfig `yaml:"rooms"`
+	// Network sets the ports and addresses of the SFU's ICE candidates,
+	// see network.go.
+	Network NetworkConfig `yaml:"network"`
+	// TURN is the embedded TURN server, started by main before NewServer.
+	TURN TURNConfig `yaml:"turn"`
+}
+
+// HTTPConfig are the listeners of main. HTTPS only starts if the
+// certificate files exist.
+type HTTPConfig struct {
+	Port              int           `yaml:"port" env:"HTTP_PORT"`
+	HTTPSPort         int           `yaml:"httpsPort" env:"HTTPS_PORT"`
+	CertFile          string        `yaml:"certFile" env:"CERT_FILE"`
+	KeyFile           string        `yaml:"keyFile" env:"KEY_FILE"`
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout" env:"HTTP_READ_HEADER_TIMEOUT"`
+}
+
+// SignalingConfig are the limits of the WebSocket signaling.
+type SignalingConfig struct {
+	// PongWait closes a connection that has not answered a ping for this
+	// long. Pings are sent every 9/10 of it.
+	PongWait  time.Duration `yaml:"pongWait" env:"WS_PONG_WAIT"`
+	WriteWait time.Duration `yaml:"writeWait" env:"WS_WRITE_WAIT"`
+	// MaxMessageSize is the largest signal accepted, in bytes.
+	MaxMessageSize int64 `yaml:"maxMessageSize" env:"WS_MAX_MESSAGE_SIZE"`
+	// MaxFieldLength caps the session ID, user ID and user name of a join.
+	MaxFieldLength int `yaml:"maxFieldLength" env:"JOIN_MAX_FIELD_LENGTH"`
+	// AuthTimeout bounds the authorizer call of a join.
+	AuthTimeout time.Duration `yaml:"authTimeout" env:"AUTH_TIMEOUT"`
+	// SendBuffer is how many signals may wait to be written to a peer.
+	SendBuffer int `yaml:"sendBuffer" env:"PEER_SEND_BUFFER"`
+}
+
+func (c SignalingConfig) pingPeriod() time.Duration {
+	return c.PongWait * 9 / 10
+}
+
+// DefaultConfig returns the configuration used when nothing is overridden.
+func DefaultConfig() Config {
+	signaling := SignalingConfig{
+		PongWait:       30 * time.Second,
+		WriteWait:      10 * time.Second,
+		MaxMessageSize: 64 * 1024,
+		MaxFieldLength: 256,
+		AuthTimeout:    5 * time.Second,
+		SendBuffer:     32,
+	}
+	return Config{
+		HTTP: HTTPConfig{
+			Port:              8080,
+			HTTPSPort:         8443,
+			CertFile:          "/etc/apache2/ssl/localhost.crt",
+			KeyFile:           "/etc/apache2/ssl/localhost.key",
+			ReadHeaderTimeout: 5 * time.Second,
+		},
+		Signaling:         signaling,
+		Tokens:            TokenConfig{Leeway: 30 * time.Second},
+		DefaultRole:       RoleStudent,
+		StudentsAudioOnly: false,
+		StudentsMuted:     false,
+		Rooms: RoomConfig{
+			EmptyTimeout:      30 * time.Second,
+			ResumeGrace:       30 * time.Second,
+			ICERestartDelay:   2 * time.Second,
+			ICEFailureTimeout: 30 * time.Second,
+			ClosingWarnings:   []time.Duration{5 * time.Minute, time.Minute},
+			Egress:            EgressConfig{HLSKeep: time.Minute},
+			Chat:              ChatConfig{Replay: 50},
+			signaling:         signaling,
+		},
+		TURN: TURNConfig{UserQuota: 10},
+	}
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	port := func(name string, p int) {
+		check(p >= 0 && p <= 65535, "%s: invalid port %d", name, p)
+	}
+
+	port("http.port", c.HTTP.Port)
+	port("http.httpsPort", c.HTTP.HTTPSPort)
+	check(c.HTTP.Port > 0, "http.port is required")
+
+	s := c.Signaling
+	check(s.PongWait > 0 && s.WriteWait > 0 && s.AuthTimeout > 0, "signaling: timeouts must be positive")
+	check(s.MaxMessageSize > 0 && s.MaxFieldLength > 0, "signaling: limits must be positive")
+	check(s.SendBuffer > 0, "signaling.sendBuffer must be positive")
+
+	check(ParseRole(string(c.DefaultRole)) != "", "defaultRole: invalid role %q", c.DefaultRole)
+
+	r := c.Rooms
+	check(r.MaxParticipants >= 0 && r.MaxPublishers >= 0 && r.MaxViewers >= 0 && r.LastN >= 0, "rooms: limits must not be negative")
+	check(r.EmptyTimeout >= 0 && r.ResumeGrace >= 0 && r.MaxDuration >= 0, "rooms: durations must not be negative")
+	check(r.ICERestartDelay >= 0 && r.ICEFailureTimeout >= 0, "rooms: ICE recovery durations must not be negative")
+	switch r.Recording.Mix {
+	case "", MixOgg, MixWAV:
+	default:
+		check(false, "rooms.recording.mix: %q (ogg or wav)", r.Recording.Mix)
+	}
+	// The audio mix and the egress run ffmpeg, better to know at startup
+	if r.Recording.Mix != "" {
+		if _, err := exec.LookPath(ffmpegPath(r.Recording.FFmpegPath)); err != nil {
+			errs = append(errs, fmt.Errorf("rooms.recording.mix needs ffmpeg: %w", err))
+		}
+	}
+	if r.Egress.HLSDir != "" || len(r.Egress.PushPrefixes) > 0 {
+		if _, err := exec.LookPath(ffmpegPath(r.Egress.FFmpegPath)); err != nil {
+			errs = append(errs, fmt.Errorf("rooms.egress needs ffmpeg: %w", err))
+		}
+	}
+	check(r.Egress.HLSKeep >= 0, "rooms.egress.hlsKeep must not be negative")
+	check(r.Chat.Replay >= 0, "rooms.chat.replay must not be negative")
+	check(r.Chat.ExportURL == "" || r.Chat.Secret != "", "rooms.chat.exportUrl needs rooms.chat.secret to sign the export")
+	for _, server := range r.ICE.Servers {
+		for _, u := range server.URLs {
+			if _, err := ParseICEURLs(u, "", ""); err != nil {
+				errs = append(errs, fmt.Errorf("rooms.ice.servers: %w", err))
+			}
+		}
+	}
+
+	port("network.udpPort", c.Network.UDPPort)
+	port("network.tcpPort", c.Network.TCPPort)
+	for _, ip := range c.Network.NAT1To1IPs {
+		check(net.ParseIP(ip) != nil, "network.nat1to1Ips: invalid IP %q", ip)
+	}
+	if _, err := c.Network.ipFilter(); err != nil {
+		errs = append(errs, fmt.Errorf("network.networks: %w", err))
+	}
+
+	t := c.TURN
+	port("turn.udpPort", t.UDPPort)
+	port("turn.tcpPort", t.TCPPort)
+	port("turn.tlsPort", t.TLSPort)
+	if t.RelayMinPort != 0 || t.RelayMaxPort != 0 {
+		check(t.RelayMinPort > 0 && t.RelayMaxPort >= t.RelayMinPort && t.RelayMaxPort <= 65535,
+			"turn: invalid relay port range %d-%d", t.RelayMinPort, t.RelayMaxPort)
+	}
+	check(t.UserQuota >= 0, "turn.userQuota must not be negative")
+	if t.Enabled() {
+		check(net.ParseIP(t.PublicIP).To4() != nil, "turn.publicIp: a public IPv4 address is required")
+		check(t.TLSPort == 0 || (t.CertFile != "" && t.KeyFile != ""), "turn.tlsPort needs a certificate")
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,287 @@
+package sfu
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LoadConfig builds the configuration from, by increasing precedence, the
+// defaults, the YAML file named by -config (or SFU_CONFIG), the environment
+// variables and the command-line flags in args, then validates it. Every
+// setting has a flag named after its key in the file, in kebab case:
+// rooms.maxParticipants is -rooms.max-participants. The STUN/TURN server
+// list is only read from the file or from ICE_SERVERS.
+func LoadConfig(args []string) (Config, error) {
+	cfg := DefaultConfig()
+	root := reflect.ValueOf(&cfg).Elem()
+
+	fs := flag.NewFlagSet("webrtc-sfu", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("SFU_CONFIG"), "YAML configuration file (SFU_CONFIG)")
+	// Flags are applied last, over the file and the environment
+	var flagged []func()
+	walkConfig(root, "", func(key string, field reflect.StructField, value reflect.Value) {
+		if !configSettable(value.Type()) {
+			return
+		}
+		usage := key
+		if env := field.Tag.Get("env"); env != "" {
+			usage += " (" + env + ")"
+		}
+		fs.Var(&configFlag{
+			isBool: value.Kind() == reflect.Bool,
+			set: func(s string) error {
+				parsed := reflect.New(value.Type()).Elem()
+				if err := setConfigValue(parsed, s); err != nil {
+					return err
+				}
+				flagged = append(flagged, func() { value.Set(parsed) })
+				return nil
+			},
+		}, flagName(key), usage)
+	})
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *path != "" {
+		if err := loadConfigFile(&cfg, *path); err != nil {
+			return cfg, err
+		}
+	}
+	if err := loadConfigEnv(&cfg, root); err != nil {
+		return cfg, err
+	}
+	for _, set := range flagged {
+		set()
+	}
+
+	// Derived defaults
+	if role := ParseRole(string(cfg.DefaultRole)); role != "" {
+		cfg.DefaultRole = role
+	}
+	if cfg.TURN.CertFile == "" {
+		cfg.TURN.CertFile = cfg.HTTP.CertFile
+	}
+	if cfg.TURN.KeyFile == "" {
+		cfg.TURN.KeyFile = cfg.HTTP.KeyFile
+	}
+	cfg.Rooms.signaling = cfg.Signaling
+
+	return cfg, cfg.Validate()
+}
+
+// loadConfigFile reads the YAML file at path. Other formats (TOML, JSON...)
+// are rejected by extension rather than fed to the YAML decoder, which
+// would fail on them with a confusing error or, for JSON, half accept them.
+func loadConfigFile(cfg *Config, path string) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+	default:
+		return fmt.Errorf("%s: unsupported config file, only YAML (.yaml or .yml) is supported", path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	// A misspelled key is an error, not a silently ignored setting
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// loadConfigEnv applies the environment variables named by the env tags,
+// plus the ones that do not map to a single field. Empty variables are
+// ignored.
+func loadConfigEnv(cfg *Config, root reflect.Value) error {
+	var errs []error
+	walkConfig(root, "", func(_ string, field reflect.StructField, value reflect.Value) {
+		env := field.Tag.Get("env")
+		if env == "" {
+			return
+		}
+		if v := os.Getenv(env); v != "" {
+			if err := setConfigValue(value, v); err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s: %w", env, err))
+			}
+		}
+	})
+
+	if v := os.Getenv("ICE_SERVERS"); v != "" {
+		servers, err := ParseICEURLs(v, os.Getenv("TURN_USERNAME"), os.Getenv("TURN_PASSWORD"))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid ICE_SERVERS: %w", err))
+		}
+		cfg.Rooms.ICE.Servers = servers
+	}
+	if v := os.Getenv("TURN_RELAY_PORTS"); v != "" {
+		lo, hi, _ := strings.Cut(v, "-")
+		var err error
+		if cfg.TURN.RelayMinPort, err = strconv.Atoi(lo); err == nil {
+			cfg.TURN.RelayMaxPort, err = strconv.Atoi(hi)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid TURN_RELAY_PORTS: %q (min-max)", v))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Redacted returns the configuration as YAML, with the secrets hidden, to
+// be logged at startup.
+func (c Config) Redacted() string {
+	redactConfig(reflect.ValueOf(&c).Elem())
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+// redactConfig hides the fields tagged redact in v, which must be a copy:
+// the slices it descends into are copied first.
+func redactConfig(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		field, value := v.Type().Field(i), v.Field(i)
+		switch {
+		case !field.IsExported():
+		case field.Tag.Get("redact") == "true" && value.Kind() == reflect.String && value.String() != "":
+			value.SetString("[redacted]")
+		case value.Kind() == reflect.Struct:
+			redactConfig(value)
+		case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Struct && value.Len() > 0:
+			elems := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+			reflect.Copy(elems, value)
+			value.Set(elems)
+			for j := 0; j < elems.Len(); j++ {
+				redactConfig(elems.Index(j))
+			}
+		}
+	}
+}
+
+// walkConfig calls fn for every setting below v, a struct, with its key
+// in the file.
+func walkConfig(v reflect.Value, prefix string, fn func(key string, field reflect.StructField, value reflect.Value)) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if !field.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		if field.Type.Kind() == reflect.Struct {
+			walkConfig(v.Field(i), prefix+name+".", fn)
+			continue
+		}
+		fn(prefix+name, field, v.Field(i))
+	}
+}
+
+var (
+	durationType      = reflect.TypeOf(time.Duration(0))
+	durationSliceType = reflect.TypeOf([]time.Duration(nil))
+	stringSliceType   = reflect.TypeOf([]string(nil))
+)
+
+// configSettable reports whether a setting of type t can be given as a
+// single string, as environment variables and flags are.
+func configSettable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int64:
+		return true
+	}
+	return t == durationSliceType || t == stringSliceType
+}
+
+// setConfigValue parses s into v. Durations are "90s" or "2h", lists are
+// comma-separated.
+func setConfigValue(v reflect.Value, s string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Type() == durationSliceType:
+		var list []time.Duration
+		for _, item := range splitConfigList(s) {
+			d, err := time.ParseDuration(item)
+			if err != nil {
+				return err
+			}
+			list = append(list, d)
+		}
+		v.Set(reflect.ValueOf(list))
+	case v.Type() == stringSliceType:
+		v.Set(reflect.ValueOf(splitConfigList(s)))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Int, v.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+func splitConfigList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// flagName turns a key in the file into a flag name:
+// rooms.ice.turnCredentialTTL is rooms.ice.turn-credential-ttl.
+func flagName(key string) string {
+	var b strings.Builder
+	var prev rune
+	for _, r := range key {
+		if unicode.IsUpper(r) && (unicode.IsLower(prev) || unicode.IsDigit(prev)) {
+			b.WriteByte('-')
+		}
+		b.WriteRune(unicode.ToLower(r))
+		prev = r
+	}
+	return b.String()
+}
+
+// configFlag is a flag.Value that sets a setting.
+type configFlag struct {
+	isBool bool
+	set    func(string) error
+}
+
+func (f *configFlag) String() string     { return "" }
+func (f *configFlag) Set(s string) error { return f.set(s) }
+func (f *configFlag) IsBoolFlag() bool   { return f.isBool }
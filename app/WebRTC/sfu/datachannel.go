@@ -0,0 +1,220 @@
+package sfu
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v3"
+)
+
+// In-room messages (chat, reactions, raised hands) travel over two SCTP
+// DataChannels the server opens on every sub PeerConnection:
+//
+//	reliable  ordered, retransmitted: chat, hand
+//	lossy     unordered, no retransmits: reaction
+//
+// Clients send {type, text|emoji|raised} on either channel. The room relays
+// the message to every joined peer, sender included, on the channel of its
+// type, with the identity of the sender (from), the server time (at) and
+// an id stamped by the server. Oversized or too frequent messages are
+// answered with {type: "error"} on the reliable channel.
+const (
+	dataChannelReliable = "reliable"
+	dataChannelLossy    = "lossy"
+
+	dataMaxMessage  = 4096    // bytes of a client message
+	dataMaxChatText = 2000    // bytes of a chat text
+	dataMaxEmoji    = 32      // bytes of a reaction
+	dataMaxBuffered = 1 << 20 // queued bytes after which messages to a peer are dropped
+)
+
+// dataPolicy is the channel and rate limit of a message type. Rates are
+// per peer, burst messages and then rate per second.
+type dataPolicy struct {
+	channel string
+	rate    float64
+	burst   float64
+}
+
+var dataPolicies = map[string]dataPolicy{
+	"chat":     {channel: dataChannelReliable, rate: 5, burst: 10},
+	"reaction": {channel: dataChannelLossy, rate: 10, burst: 20},
+	"hand":     {channel: dataChannelReliable, rate: 1, burst: 3},
+}
+
+// DataMessage is a message relayed over the data channels. Chat and
+// reaction messages are also kept in the room chat log, see chat_log.go.
+type DataMessage struct {
+	Type    string      `json:"type"`
+	ID      string      `json:"id,omitempty"`
+	From    *DataSender `json:"from,omitempty"`
+	At      int64       `json:"at,omitempty"` // unix ms
+	Text    string      `json:"text,omitempty"`
+	Emoji   string      `json:"emoji,omitempty"`
+	Raised  *bool       `json:"raised,omitempty"`
+	Message string      `json:"message,omitempty"` // errors
+}
+
+type DataSender struct {
+	PeerID   string `json:"peerId"`
+	UserID   string `json:"userId"`
+	UserName string `json:"userName,omitempty"`
+	Role     string `json:"role,omitempty"`
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token if there is one, refilling rate tokens per second up
+// to burst.
+func (b *tokenBucket) allow(policy dataPolicy, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = policy.burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * policy.rate
+		if b.tokens > policy.burst {
+			b.tokens = policy.burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// setupDataChannels opens the reliable and lossy channels on the sub
+// PeerConnection. They are negotiated with the first sub_offer, which is
+// sent on sub_ready even if there are no tracks yet.
+func (p *Peer) setupDataChannels() error {
+	ordered := false
+	retransmits := uint16(0)
+	inits := map[string]*webrtc.DataChannelInit{
+		dataChannelReliable: nil,
+		dataChannelLossy:    {Ordered: &ordered, MaxRetransmits: &retransmits},
+	}
+	for label, init := range inits {
+		dc, err := p.subPC.CreateDataChannel(label, init)
+		if err != nil {
+			return err
+		}
+		dc.OnMessage(p.handleDataMessage)
+		p.dataChannels[label] = dc
+	}
+	p.pendingSubNegotiation = true
+	return nil
+}
+
+func (p *Peer) handleDataMessage(raw webrtc.DataChannelMessage) {
+	if !raw.IsString || len(raw.Data) > dataMaxMessage {
+		p.sendDataError("invalid message")
+		return
+	}
+	var msg DataMessage
+	if err := json.Unmarshal(raw.Data, &msg); err != nil {
+		p.sendDataError("invalid message")
+		return
+	}
+	policy, ok := dataPolicies[msg.Type]
+	if !ok {
+		p.sendDataError("unknown message type")
+		return
+	}
+
+	out := DataMessage{Type: msg.Type}
+	switch msg.Type {
+	case "chat":
+		if msg.Text == "" || len(msg.Text) > dataMaxChatText || !utf8.ValidString(msg.Text) {
+			p.sendDataError("invalid chat text")
+			return
+		}
+		out.Text = msg.Text
+	case "reaction":
+		if msg.Emoji == "" || len(msg.Emoji) > dataMaxEmoji || !utf8.ValidString(msg.Emoji) {
+			p.sendDataError("invalid reaction")
+			return
+		}
+		out.Emoji = msg.Emoji
+	case "hand":
+		raised := msg.Raised != nil && *msg.Raised
+		out.Raised = &raised
+	}
+
+	p.dataMu.Lock()
+	bucket := p.dataBuckets[msg.Type]
+	if bucket == nil {
+		bucket = &tokenBucket{}
+		p.dataBuckets[msg.Type] = bucket
+	}
+	allowed := bucket.allow(policy, time.Now())
+	p.dataMu.Unlock()
+	if !allowed {
+		p.sendDataError("rate limit exceeded: " + msg.Type)
+		return
+	}
+
+	out.ID = uuid.NewString()
+	out.At = time.Now().UnixMilli()
+	out.From = &DataSender{PeerID: p.id, UserID: p.userID, UserName: p.userName, Role: string(p.role)}
+	p.room.RelayData(p, out)
+	// A student's hand also goes through the queue, see hand_queue.go
+	if msg.Type == "hand" && p.role == RoleStudent {
+		p.setHandRaised(*out.Raised)
+	}
+}
+
+// RelayData sends msg to every joined peer on the channel of its type.
+// Peers in the lobby and WHIP publishers have no open channels.
+func (r *Room) RelayData(from *Peer, msg DataMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("[ROOM %s] data marshal error: %v", r.id, err)
+		return
+	}
+	label := dataPolicies[msg.Type].channel
+
+	r.mu.RLock()
+	if r.peers[from.id] != from {
+		r.mu.RUnlock()
+		return
+	}
+	for _, peer := range r.peers {
+		peer.sendData(label, data)
+	}
+	r.mu.RUnlock()
+
+	if msg.Type == "chat" || msg.Type == "reaction" {
+		r.chat.append(msg, data)
+	}
+}
+
+// sendData writes to the channel label if it is open. Messages are dropped
+// for peers that do not keep up.
+func (p *Peer) sendData(label string, data []byte) {
+	dc := p.dataChannels[label]
+	if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return
+	}
+	if dc.BufferedAmount() > dataMaxBuffered {
+		log.Printf("[PEER %s] %s channel congested, message dropped", p.id[:8], label)
+		return
+	}
+	if err := dc.SendText(string(data)); err != nil {
+		log.Printf("[PEER %s] data send error: %v", p.id[:8], err)
+	}
+}
+
+func (p *Peer) sendDataError(message string) {
+	log.Printf("[PEER %s] data error: %s", p.id[:8], message)
+	data, err := json.Marshal(DataMessage{Type: "error", Message: message})
+	if err != nil {
+		return
+	}
+	p.sendData(dataChannelReliable, data)
+}
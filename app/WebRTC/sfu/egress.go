@@ -0,0 +1,606 @@
+package sfu
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Egress live-streams a room outside WebRTC: the screen share (or camera)
+// and the audio of the hosts are forwarded as plain RTP to a local ffmpeg,
+// which transcodes them to H.264/AAC and writes HLS or pushes to an RTMP or
+// SRT server. When the host starts or stops sharing the screen the sources
+// are switched under ffmpeg by a switchingSink, so the output never
+// restarts.
+const (
+	EgressHLS  = "hls"
+	EgressRTMP = "rtmp"
+	EgressSRT  = "srt"
+
+	hlsPathPrefix        = "/hls/"
+	hlsPlaylist          = "index.m3u8"
+	egressSelectInterval = 2 * time.Second
+	egressStopTimeout    = 5 * time.Second
+	egressVideoPT        = 96
+	egressAudioPT        = 111
+)
+
+var (
+	ErrEgressDisabled = errors.New("egress disabled")
+	ErrEgressRunning  = errors.New("egress already running")
+	ErrEgressURL      = errors.New("egress url not allowed")
+	ErrEgressNoVideo  = errors.New("nothing to stream: no host camera or screen")
+)
+
+// EgressConfig configures live-streaming rooms outside WebRTC. It needs
+// ffmpeg, FFmpegPath defaults to the one in PATH.
+type EgressConfig struct {
+	// HLSDir is where HLS playlists and segments are written, served under
+	// /hls/. Empty disables HLS.
+	HLSDir string `yaml:"hlsDir" env:"EGRESS_HLS_DIR"`
+	// HLSSegmentType is fmp4 (default) or mpegts.
+	HLSSegmentType string `yaml:"hlsSegmentType" env:"EGRESS_HLS_SEGMENT_TYPE"`
+	// HLSKeep is how long the playlist and segments of a stopped HLS
+	// egress are still served, so that players reach #EXT-X-ENDLIST,
+	// before they are removed.
+	HLSKeep time.Duration `yaml:"hlsKeep" env:"EGRESS_HLS_KEEP"`
+	// PushPrefixes are the rtmp:// and srt:// URL prefixes hosts may push
+	// to. Empty disables pushing.
+	PushPrefixes []string `yaml:"pushPrefixes" env:"EGRESS_PUSH_PREFIXES"`
+	FFmpegPath   string   `yaml:"ffmpegPath" env:"EGRESS_FFMPEG"`
+}
+
+// Egress is one running live stream of a room.
+type Egress struct {
+	id     string
+	kind   string
+	url    string // push destination, or the playlist path for HLS
+	room   *Room
+	subID  string
+	hlsDir string
+	keep   time.Duration // HLSKeep
+
+	cmd       *exec.Cmd
+	videoConn udpWriter
+	audioConn udpWriter
+	video     *switchingSink
+	audio     *switchingSink
+
+	mu          sync.Mutex
+	videoSource *PublishedTrack
+	audioSource *PublishedTrack
+
+	refresh  chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	exited   chan struct{} // ffmpeg exited, with err
+	err      error
+	done     chan struct{} // sources detached and room told
+}
+
+// egressSources picks what is streamed: the screen share of a host, else
+// the camera of a host, and the audio of a host. Only video in videoMime
+// is considered when it is set. The choice is stable (lowest key) so that
+// two hosts do not make it flap.
+func (r *Room) egressSources(videoMime string) (video, audio *PublishedTrack) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, pub := range r.published {
+		if pub.publisher == nil || pub.publisher.role != RoleHost {
+			continue
+		}
+		switch {
+		case pub.kind == webrtc.RTPCodecTypeAudio:
+			if pub.media == mediaAudio && (audio == nil || pub.key < audio.key) {
+				audio = pub
+			}
+		case videoMime != "" && !strings.EqualFold(pub.codec.MimeType, videoMime):
+		case pub.media == mediaScreen:
+			if video == nil || video.media != mediaScreen || pub.key < video.key {
+				video = pub
+			}
+		default:
+			if video == nil || (video.media != mediaScreen && pub.key < video.key) {
+				video = pub
+			}
+		}
+	}
+	return video, audio
+}
+
+// StartEgress starts streaming the room as kind (hls, rtmp or srt). url is
+// the destination of rtmp and srt.
+func (r *Room) StartEgress(by *Peer, kind string, url string) (*Egress, error) {
+	cfg := r.cfg.Egress
+	switch kind {
+	case EgressHLS:
+		if cfg.HLSDir == "" {
+			return nil, ErrEgressDisabled
+		}
+		url = ""
+	case EgressRTMP, EgressSRT:
+		if len(cfg.PushPrefixes) == 0 {
+			return nil, ErrEgressDisabled
+		}
+		if !strings.HasPrefix(url, kind+"://") || !hasAnyPrefix(url, cfg.PushPrefixes) {
+			return nil, ErrEgressURL
+		}
+	default:
+		return nil, fmt.Errorf("unknown egress %q", kind)
+	}
+
+	video, _ := r.egressSources("")
+	if video == nil {
+		return nil, ErrEgressNoVideo
+	}
+
+	// The destination is reserved while ffmpeg starts, outside the room
+	// lock so that joins and publishes do not wait for it
+	slot := kind + " " + url
+	r.mu.Lock()
+	running := r.reserved[slot]
+	for _, e := range r.egress {
+		if e.kind == kind && (kind == EgressHLS || e.url == url) {
+			running = true
+		}
+	}
+	if running {
+		r.mu.Unlock()
+		return nil, ErrEgressRunning
+	}
+	r.reserved[slot] = true
+	r.mu.Unlock()
+
+	e, err := newEgress(r, cfg, kind, url, video.codec.MimeType)
+
+	r.mu.Lock()
+	delete(r.reserved, slot)
+	if err == nil {
+		r.egress[e.id] = e
+	}
+	r.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	go e.run()
+	log.Printf("[ROOM %s] egress %s (%s) started by %s", r.id, e.id, kind, by.id[:8])
+	r.BroadcastToAll(e.startedSignal())
+	return e, nil
+}
+
+// StopEgress stops the egress id, or all of them when id is empty.
+func (r *Room) StopEgress(id string) bool {
+	r.mu.RLock()
+	var stopping []*Egress
+	for _, e := range r.egress {
+		if id == "" || e.id == id {
+			stopping = append(stopping, e)
+		}
+	}
+	r.mu.RUnlock()
+
+	for _, e := range stopping {
+		e.Stop()
+	}
+	return len(stopping) > 0
+}
+
+// refreshFollowers makes the egresses and WHEP viewers re-pick their
+// sources now rather than on their next tick.
+func (r *Room) refreshFollowers() {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, e := range r.egress {
+		select {
+		case e.refresh <- struct{}{}:
+		default:
+		}
+	}
+	for _, v := range r.viewers {
+		select {
+		case v.refresh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (r *Room) egressSignals() []Signal {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	signals := make([]Signal, 0, len(r.egress))
+	for _, e := range r.egress {
+		signals = append(signals, e.startedSignal())
+	}
+	return signals
+}
+
+func newEgress(room *Room, cfg EgressConfig, kind string, url string, videoMime string) (*Egress, error) {
+	id := randomHex(8)
+	e := &Egress{
+		id:      id,
+		kind:    kind,
+		url:     url,
+		room:    room,
+		subID:   "egress:" + id,
+		keep:    cfg.HLSKeep,
+		refresh: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		exited:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	started := false
+	defer func() {
+		if !started && e.hlsDir != "" {
+			_ = os.RemoveAll(e.hlsDir)
+		}
+	}()
+
+	var output []string
+	if kind == EgressHLS {
+		// The directory name is the capability to watch: unguessable
+		name := safeFileName(room.id) + "-" + randomHex(16)
+		e.hlsDir = filepath.Join(cfg.HLSDir, name)
+		e.url = hlsPathPrefix + name + "/" + hlsPlaylist
+		if err := os.MkdirAll(e.hlsDir, 0o755); err != nil {
+			return nil, fmt.Errorf("create hls dir: %w", err)
+		}
+		output = hlsOutputArgs(e.hlsDir, cfg.HLSSegmentType)
+	} else {
+		format := "flv"
+		if kind == EgressSRT {
+			format = "mpegts"
+		}
+		output = []string{"-f", format, url}
+	}
+
+	videoPort, err := freeRTPPort()
+	if err != nil {
+		return nil, err
+	}
+	audioPort, err := freeRTPPort()
+	if err != nil {
+		return nil, err
+	}
+	if e.videoConn, err = dialUDPWriter(videoPort); err != nil {
+		return nil, err
+	}
+	if e.audioConn, err = dialUDPWriter(audioPort); err != nil {
+		e.videoConn.close()
+		return nil, err
+	}
+	e.video = newSwitchingSink(e.videoConn, egressVideoPT, uint32(videoPort)<<16|egressVideoPT, 90000, videoMime)
+	e.audio = newSwitchingSink(e.audioConn, egressAudioPT, uint32(audioPort)<<16|egressAudioPT, 48000, webrtc.MimeTypeOpus)
+
+	args := append(egressInputArgs(), output...)
+	e.cmd = exec.Command(ffmpegPath(cfg.FFmpegPath), args...)
+	e.cmd.Stdin = strings.NewReader(egressSDP(videoPort, videoMime, audioPort))
+	stderr := &tailWriter{}
+	e.cmd.Stderr = stderr
+	if err := e.cmd.Start(); err != nil {
+		e.videoConn.close()
+		e.audioConn.close()
+		return nil, fmt.Errorf("start ffmpeg: %w", err)
+	}
+	go func() {
+		err := e.cmd.Wait()
+		if err != nil {
+			err = fmt.Errorf("%w: %s", err, lastLines(stderr.String(), 3))
+		}
+		e.err = err
+		close(e.exited)
+	}()
+	started = true
+	return e, nil
+}
+
+func (e *Egress) run() {
+	e.selectSources()
+	ticker := time.NewTicker(egressSelectInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.selectSources()
+		case <-e.refresh:
+			e.selectSources()
+		case <-e.stop:
+			_ = e.cmd.Process.Signal(os.Interrupt) // let ffmpeg finish the playlist
+			select {
+			case <-e.exited:
+			case <-time.After(egressStopTimeout):
+				_ = e.cmd.Process.Kill()
+				<-e.exited
+			}
+			e.finish(nil)
+			return
+		case <-e.exited:
+			e.finish(e.err)
+			return
+		}
+	}
+}
+
+// selectSources moves the sinks to the current sources.
+func (e *Egress) selectSources() {
+	video, audio := e.room.egressSources(e.video.mimeType)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.videoSource = e.attach(e.videoSource, video, e.video)
+	e.audioSource = e.attach(e.audioSource, audio, e.audio)
+}
+
+func (e *Egress) attach(current, next *PublishedTrack, sink *switchingSink) *PublishedTrack {
+	if current == next {
+		return current
+	}
+	if current != nil {
+		current.RemoveSubscriber(e.subID)
+	}
+	if next != nil {
+		sink.switchSource()
+		next.AddSubscriber(e.subID, sink, false)
+		log.Printf("[ROOM %s] egress %s now streams %s", e.room.id, e.id, next.key)
+	}
+	return next
+}
+
+func (e *Egress) finish(err error) {
+	e.mu.Lock()
+	for _, pub := range []*PublishedTrack{e.videoSource, e.audioSource} {
+		if pub != nil {
+			pub.RemoveSubscriber(e.subID)
+		}
+	}
+	e.videoSource, e.audioSource = nil, nil
+	e.mu.Unlock()
+	e.videoConn.close()
+	e.audioConn.close()
+
+	r := e.room
+	r.mu.Lock()
+	delete(r.egress, e.id)
+	r.mu.Unlock()
+
+	stopped := Signal{Type: "egress_stopped", EgressID: e.id, Egress: e.kind}
+	if err != nil {
+		log.Printf("[ROOM %s] egress %s failed: %v", r.id, e.id, err)
+		stopped.Message = "egress failed"
+	} else {
+		log.Printf("[ROOM %s] egress %s stopped", r.id, e.id)
+	}
+	r.BroadcastToAll(stopped)
+	if e.hlsDir != "" {
+		time.AfterFunc(e.keep, e.removeHLS)
+	}
+	close(e.done)
+}
+
+// removeHLS deletes the playlist and segments of a stopped HLS egress.
+func (e *Egress) removeHLS() {
+	if err := os.RemoveAll(e.hlsDir); err != nil {
+		log.Printf("[ROOM %s] egress %s: %v", e.room.id, e.id, err)
+	}
+}
+
+// Stop ends the egress and waits until ffmpeg exited and it is detached.
+func (e *Egress) Stop() {
+	e.stopOnce.Do(func() { close(e.stop) })
+	<-e.done
+}
+
+// startedSignal announces the egress; push URLs are not sent since they
+// usually carry a stream key.
+func (e *Egress) startedSignal() Signal {
+	msg := Signal{Type: "egress_started", EgressID: e.id, Egress: e.kind}
+	if e.kind == EgressHLS {
+		msg.URL = e.url
+	}
+	return msg
+}
+
+// handleEgress implements the host-only `start_egress` and `stop_egress`
+// commands.
+func (p *Peer) handleEgress(msg Signal) {
+	if !p.isHost() {
+		p.sendError("not allowed: host only")
+		return
+	}
+
+	if msg.Type == "stop_egress" {
+		if !p.room.StopEgress(msg.EgressID) {
+			p.sendError("egress not found")
+		}
+		return
+	}
+	if _, err := p.room.StartEgress(p, msg.Egress, msg.URL); err != nil {
+		log.Printf("[PEER %s] start_egress: %v", p.id[:8], err)
+		switch {
+		case errors.Is(err, ErrEgressDisabled), errors.Is(err, ErrEgressRunning),
+			errors.Is(err, ErrEgressURL), errors.Is(err, ErrEgressNoVideo):
+			p.sendError(err.Error())
+		default:
+			p.sendError("egress failed")
+		}
+	}
+}
+
+// udpWriter sends RTP packets to ffmpeg over local UDP.
+type udpWriter struct {
+	conn *net.UDPConn
+}
+
+func dialUDPWriter(port int) (udpWriter, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	return udpWriter{conn: conn}, err
+}
+
+func (u udpWriter) WriteRTP(pkt *rtp.Packet) error {
+	data, err := pkt.Marshal()
+	if err != nil {
+		return err
+	}
+	// Refused while ffmpeg is still starting, nothing to do about it
+	_, _ = u.conn.Write(data)
+	return nil
+}
+
+func (u udpWriter) close() {
+	_ = u.conn.Close()
+}
+
+// freeRTPPort returns an even local UDP port whose next port (RTCP, which
+// ffmpeg also binds) is free too.
+func freeRTPPort() (int, error) {
+	for i := 0; i < 20; i++ {
+		rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return 0, err
+		}
+		port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+		_ = rtpConn.Close()
+		port &^= 1
+
+		free := true
+		for _, p := range []int{port, port + 1} {
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: p})
+			if err != nil {
+				free = false
+				break
+			}
+			_ = conn.Close()
+		}
+		if free {
+			return port, nil
+		}
+	}
+	return 0, errors.New("no free rtp port")
+}
+
+// egressSDP describes the two RTP streams ffmpeg receives.
+func egressSDP(videoPort int, videoMime string, audioPort int) string {
+	codec := strings.TrimPrefix(strings.ToUpper(videoMime), "VIDEO/")
+	var sdp strings.Builder
+	sdp.WriteString("v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=egress\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\n")
+	fmt.Fprintf(&sdp, "m=video %d RTP/AVP %d\r\na=rtpmap:%d %s/90000\r\n", videoPort, egressVideoPT, egressVideoPT, codec)
+	if codec == "H264" {
+		fmt.Fprintf(&sdp, "a=fmtp:%d packetization-mode=1\r\n", egressVideoPT)
+	}
+	fmt.Fprintf(&sdp, "m=audio %d RTP/AVP %d\r\na=rtpmap:%d opus/48000/2\r\n", audioPort, egressAudioPT, egressAudioPT)
+	return sdp.String()
+}
+
+func egressInputArgs() []string {
+	return []string{
+		"-hide_banner", "-loglevel", "error",
+		"-protocol_whitelist", "pipe,udp,rtp",
+		"-f", "sdp", "-i", "pipe:0",
+		"-map", "0:v", "-map", "0:a",
+		// Fixed output size: the source switches between camera and screen
+		"-vf", "scale=1280:720:force_original_aspect_ratio=decrease,pad=1280:720:(ow-iw)/2:(oh-ih)/2",
+		"-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency",
+		"-pix_fmt", "yuv420p", "-g", "60", "-b:v", "2500k",
+		"-c:a", "aac", "-b:a", "128k", "-ar", "48000",
+	}
+}
+
+func hlsOutputArgs(dir string, segmentType string) []string {
+	ext := "m4s"
+	if segmentType == "mpegts" {
+		ext = "ts"
+	} else {
+		segmentType = "fmp4"
+	}
+	return []string{
+		"-f", "hls",
+		"-hls_time", "2",
+		"-hls_list_size", "6",
+		"-hls_flags", "delete_segments+independent_segments",
+		"-hls_segment_type", segmentType,
+		"-hls_segment_filename", filepath.Join(dir, "seg%05d."+ext),
+		filepath.Join(dir, hlsPlaylist),
+	}
+}
+
+// HLSHandler serves the HLS egresses under /hls/, or returns nil when HLS
+// is disabled. Only playlists and segments are served, never listings.
+func (s *Server) HLSHandler() http.Handler {
+	dir := s.cfg.Rooms.Egress.HLSDir
+	if dir == "" {
+		return nil
+	}
+	files := http.StripPrefix(hlsPathPrefix, http.FileServer(http.Dir(dir)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch path.Ext(r.URL.Path) {
+		case ".m3u8":
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			w.Header().Set("Cache-Control", "no-cache")
+		case ".m4s":
+			w.Header().Set("Content-Type", "video/iso.segment")
+		case ".mp4":
+			w.Header().Set("Content-Type", "video/mp4")
+		case ".ts":
+			w.Header().Set("Content-Type", "video/mp2t")
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		files.ServeHTTP(w, r)
+	})
+}
+
+// tailWriter keeps the end of ffmpeg's stderr for error messages.
+type tailWriter struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > 4096 {
+		t.buf = t.buf[len(t.buf)-4096:]
+	}
+	return len(p), nil
+}
+
+func (t *tailWriter) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.buf)
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if prefix != "" && strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
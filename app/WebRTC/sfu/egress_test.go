@@ -0,0 +1,347 @@
+package sfu
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// fakeFFmpegEnv makes the test binary run as fakeFFmpeg, so that egress
+// can be tested without ffmpeg installed.
+const fakeFFmpegEnv = "SFU_TEST_FAKE_FFMPEG"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeFFmpegEnv) != "" {
+		os.Exit(fakeFFmpeg(os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// fakeFFmpeg stands in for ffmpeg: it waits for the first video packet on
+// the port of the SDP read from stdin and delivers its output format, path
+// and payload to the output, an rtmp:// (TCP) or srt:// (UDP) server or an
+// HLS playlist and segment. Like ffmpeg, it exits when interrupted.
+func fakeFFmpeg(args []string) int {
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+
+	sdp, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var port int
+	for _, line := range strings.Split(string(sdp), "\r\n") {
+		if _, err := fmt.Sscanf(line, "m=video %d", &port); err == nil {
+			break
+		}
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var pkt rtp.Packet
+	if err := pkt.Unmarshal(buf[:n]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	output, format := args[len(args)-1], ""
+	for i := len(args) - 2; i > 0; i-- {
+		if args[i-1] == "-f" {
+			format = args[i]
+			break
+		}
+	}
+	switch {
+	case strings.HasPrefix(output, "rtmp://"), strings.HasPrefix(output, "srt://"):
+		u, err := url.Parse(output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		network := "tcp"
+		if u.Scheme == "srt" {
+			network = "udp"
+		}
+		server, err := net.Dial(network, u.Host)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Fprintf(server, "%s %s\n%s", format, u.RequestURI(), pkt.Payload)
+		_ = server.Close()
+	default:
+		dir := filepath.Dir(output)
+		if err := os.WriteFile(filepath.Join(dir, "seg00000.m4s"), pkt.Payload, 0o644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		playlist := "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.0,\nseg00000.m4s\n"
+		if err := os.WriteFile(output, []byte(playlist), 0o644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	<-interrupted
+	return 0
+}
+
+// vp8Keyframe is the start of a VP8 keyframe: payload descriptor with S=1,
+// then a frame header with P=0.
+var vp8Keyframe = []byte{0x10, 0x00, 0x00, 0x00, 0x9d, 0x01, 0x2a}
+
+// egressTestRoom returns a room in which a host publishes a VP8 camera,
+// with the fake ffmpeg configured.
+func egressTestRoom(t *testing.T, cfg EgressConfig) (*Room, *Peer, *PublishedTrack) {
+	t.Setenv(fakeFFmpegEnv, "1")
+	cfg.FFmpegPath = os.Args[0]
+
+	roomCfg := DefaultConfig().Rooms
+	roomCfg.Egress = cfg
+	room := NewRoom("lesson-1", roomCfg, func(*Room) {}, func(*Room) {})
+
+	host := &Peer{id: "host-peer-0001", userID: "7", role: RoleHost}
+	pub := &PublishedTrack{
+		key:         "host-peer-0001:camera:video",
+		publisherID: host.id,
+		publisher:   host,
+		kind:        webrtc.RTPCodecTypeVideo,
+		media:       mediaVideo,
+		codec:       webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		layers:      []*trackLayer{{}},
+		subscribers: map[string]*trackSubscriber{},
+		done:        make(chan struct{}),
+	}
+	room.published[pub.key] = pub
+	return room, host, pub
+}
+
+// feedKeyframes writes keyframes to the subscribers of pub, as its forward
+// loop would, until the test ends.
+func feedKeyframes(t *testing.T, pub *PublishedTrack) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for seq := uint16(0); ; seq++ {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			pub.mu.RLock()
+			writers := make([]rtpWriter, 0, len(pub.subscribers))
+			for _, sub := range pub.subscribers {
+				writers = append(writers, sub.track)
+			}
+			pub.mu.RUnlock()
+			for _, w := range writers {
+				_ = w.WriteRTP(&rtp.Packet{
+					Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, Timestamp: uint32(seq) * 3000, SSRC: 1234},
+					Payload: vp8Keyframe,
+				})
+			}
+		}
+	}()
+}
+
+func stopEgress(t *testing.T, room *Room, e *Egress) {
+	e.Stop()
+	if e.err != nil {
+		t.Fatalf("ffmpeg failed: %v", e.err)
+	}
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+	if room.egress[e.id] != nil || len(room.reserved) > 0 {
+		t.Fatal("egress still registered after Stop")
+	}
+}
+
+func TestEgressPush(t *testing.T) {
+	rtmpServer, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rtmpServer.Close()
+	srtServer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srtServer.Close()
+
+	room, host, pub := egressTestRoom(t, EgressConfig{PushPrefixes: []string{"rtmp://127.0.0.1:", "srt://127.0.0.1:"}})
+	feedKeyframes(t, pub)
+
+	t.Run("rtmp", func(t *testing.T) {
+		target := "rtmp://" + rtmpServer.Addr().String() + "/live/stream-key"
+		e, err := room.StartEgress(host, EgressRTMP, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := room.StartEgress(host, EgressRTMP, target); !errors.Is(err, ErrEgressRunning) {
+			t.Fatalf("second start: err = %v, want %v", err, ErrEgressRunning)
+		}
+		if signal := e.startedSignal(); signal.URL != "" {
+			t.Fatalf("egress_started leaks the stream key: %q", signal.URL)
+		}
+
+		_ = rtmpServer.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+		conn, err := rtmpServer.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		received, err := io.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := append([]byte("flv /live/stream-key\n"), vp8Keyframe...); !bytes.Equal(received, want) {
+			t.Fatalf("rtmp server got %q, want %q", received, want)
+		}
+		stopEgress(t, room, e)
+	})
+
+	t.Run("srt", func(t *testing.T) {
+		target := "srt://" + srtServer.LocalAddr().String() + "?streamid=lesson-1"
+		e, err := room.StartEgress(host, EgressSRT, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = srtServer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1500)
+		n, _, err := srtServer.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := append([]byte("mpegts /?streamid=lesson-1\n"), vp8Keyframe...); !bytes.Equal(buf[:n], want) {
+			t.Fatalf("srt server got %q, want %q", buf[:n], want)
+		}
+		stopEgress(t, room, e)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		tests := []struct {
+			kind, url string
+			err       error
+		}{
+			{EgressRTMP, "rtmp://example.com/live/key", ErrEgressURL},
+			{EgressRTMP, "srt://127.0.0.1:9000", ErrEgressURL},
+			{EgressHLS, "", ErrEgressDisabled},
+		}
+		for _, tt := range tests {
+			if _, err := room.StartEgress(host, tt.kind, tt.url); !errors.Is(err, tt.err) {
+				t.Errorf("StartEgress(%s, %q): err = %v, want %v", tt.kind, tt.url, err, tt.err)
+			}
+		}
+	})
+}
+
+func TestEgressHLS(t *testing.T) {
+	dir := t.TempDir()
+	room, host, pub := egressTestRoom(t, EgressConfig{HLSDir: dir, HLSKeep: 50 * time.Millisecond})
+
+	e, err := room.StartEgress(host, EgressHLS, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	feedKeyframes(t, pub)
+	if !strings.HasPrefix(e.url, hlsPathPrefix+"lesson-1-") || !strings.HasSuffix(e.url, "/"+hlsPlaylist) {
+		t.Fatalf("unexpected playlist URL %q", e.url)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(e.hlsDir, hlsPlaylist)); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no playlist written")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Rooms.Egress.HLSDir = dir
+	handler := (&Server{cfg: cfg}).HLSHandler()
+	segment := strings.TrimSuffix(e.url, hlsPlaylist) + "seg00000.m4s"
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+		body        []byte
+	}{
+		{e.url, http.StatusOK, "application/vnd.apple.mpegurl", nil},
+		{segment, http.StatusOK, "video/iso.segment", vp8Keyframe},
+		{strings.TrimSuffix(e.url, hlsPlaylist), http.StatusNotFound, "", nil},
+		{hlsPathPrefix, http.StatusNotFound, "", nil},
+		{strings.TrimSuffix(e.url, hlsPlaylist) + "stderr.txt", http.StatusNotFound, "", nil},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.status {
+			t.Errorf("GET %s: status %d, want %d", tt.path, rec.Code, tt.status)
+			continue
+		}
+		if tt.contentType != "" && rec.Header().Get("Content-Type") != tt.contentType {
+			t.Errorf("GET %s: Content-Type %q, want %q", tt.path, rec.Header().Get("Content-Type"), tt.contentType)
+		}
+		if tt.body != nil && !bytes.Equal(rec.Body.Bytes(), tt.body) {
+			t.Errorf("GET %s: body %q, want %q", tt.path, rec.Body.Bytes(), tt.body)
+		}
+	}
+
+	stopEgress(t, room, e)
+	// Still served for HLSKeep, then removed
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, e.url, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("playlist gone right after stop: status %d", rec.Code)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if _, err := os.Stat(e.hlsDir); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("HLS dir not removed after HLSKeep")
+		}
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, e.url, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("playlist still served after removal: status %d", rec.Code)
+	}
+
+	if (&Server{cfg: DefaultConfig()}).HLSHandler() != nil {
+		t.Fatal("HLS handler without HLSDir")
+	}
+}
@@ -0,0 +1,162 @@
+package sfu
+
+import (
+	"log"
+	"time"
+)
+
+// Hand-raise queue. Students raise and lower their hand with
+// `raise_hand`/`lower_hand` (or a `hand` message on the data channel);
+// hosts give the floor with `call_on` and take it back with `dismiss`.
+// Being called on lets a student publish audio even if Config.StudentsMuted
+// keeps students silent, until dismissed or the hand is lowered. Every
+// change broadcasts `hand_queue`, and `peer_list` carries the queue for
+// late joiners.
+
+// HandRaise is an entry of the queue, oldest first.
+type HandRaise struct {
+	PeerID   string `json:"peerId"`
+	UserID   string `json:"userId"`
+	UserName string `json:"userName,omitempty"`
+	RaisedAt int64  `json:"raisedAt"` // unix ms
+	CalledOn bool   `json:"calledOn,omitempty"`
+}
+
+// handleHands implements `raise_hand`, `lower_hand`, `call_on` and `dismiss`.
+func (p *Peer) handleHands(msg Signal) {
+	switch msg.Type {
+	case "raise_hand", "lower_hand":
+		if p.role != RoleStudent {
+			p.sendError("only students raise hands")
+			return
+		}
+		p.setHandRaised(msg.Type == "raise_hand")
+		return
+	}
+
+	if !p.isHost() {
+		p.sendError("not allowed: host only")
+		return
+	}
+	target := p.room.GetPeer(msg.PeerID)
+	if target == nil {
+		p.sendError("unknown peer")
+		return
+	}
+	if target.role != RoleStudent {
+		p.sendError("target is not a student")
+		return
+	}
+
+	log.Printf("[PEER %s] %s on peer %s", p.id[:8], msg.Type, target.id[:8])
+	if msg.Type == "call_on" {
+		p.room.callOn(target)
+		target.setAudioGranted(true)
+	} else {
+		if _, removed := p.room.lowerHand(target.id); !removed {
+			return
+		}
+		target.setAudioGranted(false)
+	}
+	p.room.broadcastHands()
+}
+
+// setHandRaised puts the peer in the queue or takes it out, which ends its
+// turn if it was called on.
+func (p *Peer) setHandRaised(raised bool) {
+	if raised {
+		if !p.room.raiseHand(p) {
+			return
+		}
+	} else {
+		hand, removed := p.room.lowerHand(p.id)
+		if !removed {
+			return
+		}
+		if hand.CalledOn {
+			p.setAudioGranted(false)
+		}
+	}
+	p.room.broadcastHands()
+}
+
+// setAudioGranted gives or takes the temporary permission to speak. Audio
+// the peer may no longer publish is stopped.
+func (p *Peer) setAudioGranted(granted bool) {
+	p.stateMu.Lock()
+	changed := p.audioGranted != granted
+	p.audioGranted = granted
+	p.stateMu.Unlock()
+	if !changed {
+		return
+	}
+
+	if !p.canPublish(mediaAudio) {
+		p.forceStop(mediaAudio)
+	}
+	p.broadcastPermissions()
+}
+
+func (r *Room) raiseHand(peer *Peer) bool {
+	r.handMu.Lock()
+	defer r.handMu.Unlock()
+
+	for _, hand := range r.hands {
+		if hand.PeerID == peer.id {
+			return false
+		}
+	}
+	r.hands = append(r.hands, HandRaise{
+		PeerID:   peer.id,
+		UserID:   peer.userID,
+		UserName: peer.userName,
+		RaisedAt: time.Now().UnixMilli(),
+	})
+	return true
+}
+
+// lowerHand removes peerID from the queue and returns its entry.
+func (r *Room) lowerHand(peerID string) (HandRaise, bool) {
+	r.handMu.Lock()
+	defer r.handMu.Unlock()
+
+	for i, hand := range r.hands {
+		if hand.PeerID == peerID {
+			r.hands = append(r.hands[:i], r.hands[i+1:]...)
+			return hand, true
+		}
+	}
+	return HandRaise{}, false
+}
+
+// callOn marks the peer as called on, queueing it if a host calls on a
+// student that did not raise its hand.
+func (r *Room) callOn(peer *Peer) {
+	r.handMu.Lock()
+	defer r.handMu.Unlock()
+
+	for i := range r.hands {
+		if r.hands[i].PeerID == peer.id {
+			r.hands[i].CalledOn = true
+			return
+		}
+	}
+	r.hands = append(r.hands, HandRaise{
+		PeerID:   peer.id,
+		UserID:   peer.userID,
+		UserName: peer.userName,
+		RaisedAt: time.Now().UnixMilli(),
+		CalledOn: true,
+	})
+}
+
+// HandQueue returns a copy of the queue, oldest first.
+func (r *Room) HandQueue() []HandRaise {
+	r.handMu.Lock()
+	defer r.handMu.Unlock()
+	return append([]HandRaise(nil), r.hands...)
+}
+
+func (r *Room) broadcastHands() {
+	r.BroadcastToAll(Signal{Type: "hand_queue", Hands: r.HandQueue()})
+}
@@ -0,0 +1,148 @@
+package sfu
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// ICEConfig lists the STUN and TURN servers sent to clients in `joined`
+// (and `resumed`) and as Link headers to WHIP/WHEP clients. The SFU's own
+// PeerConnections only use the STUN servers, to learn their public address.
+// It is the same for every room.
+type ICEConfig struct {
+	Servers []ICEServer `yaml:"servers"`
+	// TURNSecret enables the TURN REST API scheme (the shared secret of
+	// coturn's use-auth-secret): TURN servers without a static credential
+	// get one per peer, valid for TURNCredentialTTL.
+	TURNSecret        string        `yaml:"turnSecret" env:"TURN_SECRET" redact:"true"`
+	TURNCredentialTTL time.Duration `yaml:"turnCredentialTTL" env:"TURN_CREDENTIAL_TTL"`
+}
+
+// ICEServer is an entry of RTCConfiguration.iceServers.
+type ICEServer struct {
+	URLs       []string `json:"urls" yaml:"urls"`
+	Username   string   `json:"username,omitempty" yaml:"username,omitempty"`
+	Credential string   `json:"credential,omitempty" yaml:"credential,omitempty" redact:"true"`
+}
+
+// defaultTURNCredentialTTL covers a long school day.
+const defaultTURNCredentialTTL = 12 * time.Hour
+
+// ParseICEURLs builds the server list from a comma-separated list of
+// stun:, stuns:, turn: and turns: URLs. The TURN URLs are grouped in one
+// server with the given static credential, if any.
+func ParseICEURLs(list, username, credential string) ([]ICEServer, error) {
+	var stun, turn []string
+	for _, u := range strings.Split(list, ",") {
+		u = strings.TrimSpace(u)
+		switch {
+		case u == "":
+		case isTURNURL(u):
+			turn = append(turn, u)
+		case strings.HasPrefix(u, "stun:"), strings.HasPrefix(u, "stuns:"):
+			stun = append(stun, u)
+		default:
+			return nil, fmt.Errorf("invalid ICE server URL %q", u)
+		}
+	}
+
+	var servers []ICEServer
+	if len(stun) > 0 {
+		servers = append(servers, ICEServer{URLs: stun})
+	}
+	if len(turn) > 0 {
+		servers = append(servers, ICEServer{URLs: turn, Username: username, Credential: credential})
+	}
+	return servers, nil
+}
+
+// serversFor returns the servers for userID, with TURN REST credentials
+// expiring TURNCredentialTTL after now.
+func (c ICEConfig) serversFor(userID string, now time.Time) []ICEServer {
+	servers := make([]ICEServer, 0, len(c.Servers))
+	for _, server := range c.Servers {
+		if c.TURNSecret != "" && server.Credential == "" && hasTURNURL(server.URLs) {
+			server.Username, server.Credential = turnRESTCredential(c.TURNSecret, userID, now.Add(c.credentialTTL()))
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+func (c ICEConfig) credentialTTL() time.Duration {
+	if c.TURNCredentialTTL > 0 {
+		return c.TURNCredentialTTL
+	}
+	return defaultTURNCredentialTTL
+}
+
+// turnRESTCredential implements the TURN REST API scheme
+// (draft-uberti-behave-turn-rest): the username is "<expiry>:<user>" and
+// the password base64(HMAC-SHA1(secret, username)).
+func turnRESTCredential(secret, userID string, expires time.Time) (string, string) {
+	username := strconv.FormatInt(expires.Unix(), 10)
+	if userID != "" {
+		username += ":" + userID
+	}
+	return username, turnRESTPassword(secret, username)
+}
+
+func turnRESTPassword(secret, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// peerConnectionConfig is the configuration of the SFU's PeerConnections:
+// the STUN servers only, the SFU never relays through TURN.
+func (c ICEConfig) peerConnectionConfig() webrtc.Configuration {
+	var config webrtc.Configuration
+	for _, server := range c.Servers {
+		var urls []string
+		for _, u := range server.URLs {
+			if !isTURNURL(u) {
+				urls = append(urls, u)
+			}
+		}
+		if len(urls) > 0 {
+			config.ICEServers = append(config.ICEServers, webrtc.ICEServer{URLs: urls})
+		}
+	}
+	return config
+}
+
+// iceLinkHeaders returns the Link headers that announce servers to WHIP
+// and WHEP clients (RFC 9725, section 4.6).
+func iceLinkHeaders(servers []ICEServer) []string {
+	var links []string
+	for _, server := range servers {
+		for _, u := range server.URLs {
+			link := fmt.Sprintf("<%s>; rel=\"ice-server\"", u)
+			if server.Username != "" {
+				link += fmt.Sprintf("; username=%q; credential=%q; credential-type=\"password\"", server.Username, server.Credential)
+			}
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+func isTURNURL(u string) bool {
+	return strings.HasPrefix(u, "turn:") || strings.HasPrefix(u, "turns:")
+}
+
+func hasTURNURL(urls []string) bool {
+	for _, u := range urls {
+		if isTURNURL(u) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package sfu
+
+import (
+	"log"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// ICE recovery. A PeerConnection that goes `disconnected` (no traffic for
+// a few seconds, e.g. a Wi-Fi blip) or `failed` is not closed right away:
+//
+//  1. after RoomConfig.ICERestartDelay, if it has not come back by itself,
+//     ICE is restarted. The server restarts the sub PeerConnection with
+//     the next sub_offer and sends {type: "ice_restart", target: "pub"} so
+//     that the client restarts the pub one, which it offers;
+//  2. a restart that fails is retried the same way;
+//  3. the peer is closed if the PeerConnection is not connected again
+//     within RoomConfig.ICEFailureTimeout of the first loss.
+//
+// While the peer is detached waiting for a resume, the resume restarts ICE
+// and the failure timeout waits for it.
+
+// iceRecovery tracks a PeerConnection that lost connectivity.
+type iceRecovery struct {
+	since   time.Time
+	restart *time.Timer // nil once fired, until the next loss
+	fail    *time.Timer
+}
+
+// onConnectionStateChange handles a state change of the PeerConnection
+// target ("pub" or "sub").
+func (p *Peer) onConnectionStateChange(target string, state webrtc.PeerConnectionState) {
+	switch state {
+	case webrtc.PeerConnectionStateClosed:
+		p.Close()
+	case webrtc.PeerConnectionStateConnected:
+		p.iceRecovered(target)
+	case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed:
+		if p.room.cfg.ICEFailureTimeout <= 0 {
+			p.Close()
+			return
+		}
+		p.iceLost(target, state)
+	}
+}
+
+func (p *Peer) iceLost(target string, state webrtc.PeerConnectionState) {
+	p.iceMu.Lock()
+	defer p.iceMu.Unlock()
+
+	delay := p.room.cfg.ICERestartDelay
+	if state == webrtc.PeerConnectionStateFailed {
+		// Nothing left to wait for
+		delay = 0
+	}
+	recovery := p.iceDown[target]
+	if recovery == nil {
+		log.Printf("[PEER %s] %s connection %s, restarting ICE in %s", p.id[:8], target, state, delay)
+		recovery = &iceRecovery{since: time.Now()}
+		recovery.fail = time.AfterFunc(p.room.cfg.ICEFailureTimeout, func() { p.iceFailed(target, recovery) })
+		p.iceDown[target] = recovery
+	}
+	if recovery.restart == nil {
+		recovery.restart = time.AfterFunc(delay, func() { p.iceRestart(target, recovery) })
+	} else if delay == 0 && recovery.restart.Stop() {
+		recovery.restart.Reset(0)
+	}
+}
+
+func (p *Peer) iceRecovered(target string) {
+	p.iceMu.Lock()
+	defer p.iceMu.Unlock()
+
+	recovery := p.iceDown[target]
+	if recovery == nil {
+		return
+	}
+	if recovery.restart != nil {
+		recovery.restart.Stop()
+	}
+	recovery.fail.Stop()
+	delete(p.iceDown, target)
+	log.Printf("[PEER %s] %s connection recovered after %s", p.id[:8], target, time.Since(recovery.since).Round(time.Millisecond))
+}
+
+// iceRestart restarts ICE on target if it is still down.
+func (p *Peer) iceRestart(target string, recovery *iceRecovery) {
+	p.iceMu.Lock()
+	if p.iceDown[target] != recovery {
+		p.iceMu.Unlock()
+		return
+	}
+	// The next loss, if this restart fails, schedules another one
+	recovery.restart = nil
+	p.iceMu.Unlock()
+
+	select {
+	case <-p.closed:
+		return
+	default:
+	}
+	if p.subPC == nil {
+		// WHIP publishers have no signaling to restart with
+		return
+	}
+	log.Printf("[PEER %s] restarting ICE on %s", p.id[:8], target)
+	if target == "pub" {
+		_ = p.Send(Signal{Type: "ice_restart", Target: "pub"})
+		return
+	}
+	p.subNegotiationMu.Lock()
+	p.restartSubICE = true
+	p.subNegotiationMu.Unlock()
+	p.negotiateSub()
+}
+
+// iceFailed closes the peer if target is still down, unless it waits for a
+// resume, which restarts ICE anyway.
+func (p *Peer) iceFailed(target string, recovery *iceRecovery) {
+	p.iceMu.Lock()
+	defer p.iceMu.Unlock()
+
+	if p.iceDown[target] != recovery {
+		return
+	}
+	p.connMu.Lock()
+	detached := p.detached
+	p.connMu.Unlock()
+	if detached {
+		recovery.fail.Reset(p.room.cfg.ICEFailureTimeout)
+		return
+	}
+
+	log.Printf("[PEER %s] %s connection not recovered in %s, closing", p.id[:8], target, p.room.cfg.ICEFailureTimeout)
+	delete(p.iceDown, target)
+	go p.Close()
+}
@@ -0,0 +1,146 @@
+package sfu
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// isKeyframe reports whether an RTP payload starts a keyframe, which is
+// where a subscriber can safely switch to another simulcast layer.
+// Codecs that are not inspected are treated as always switchable.
+func isKeyframe(mimeType string, payload []byte) bool {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return isVP8Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return isVP9Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return isH264Keyframe(payload)
+	}
+	return true
+}
+
+// RFC 7741 section 4.2: payload descriptor followed by the VP8 header.
+func isVP8Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	x := payload[0]&0x80 != 0
+	s := payload[0]&0x10 != 0
+	partID := payload[0] & 0x0F
+	if !s || partID != 0 {
+		return false
+	}
+
+	i := 1
+	if x {
+		if len(payload) <= i {
+			return false
+		}
+		ext := payload[i]
+		i++
+		if ext&0x80 != 0 { // I: picture ID
+			if len(payload) <= i {
+				return false
+			}
+			if payload[i]&0x80 != 0 { // M: 15-bit picture ID
+				i++
+			}
+			i++
+		}
+		if ext&0x40 != 0 { // L: TL0PICIDX
+			i++
+		}
+		if ext&0x20 != 0 || ext&0x10 != 0 { // T or K
+			i++
+		}
+	}
+	if len(payload) <= i {
+		return false
+	}
+	// P bit of the VP8 payload header: 0 means keyframe
+	return payload[i]&0x01 == 0
+}
+
+// draft-ietf-payload-vp9 section 4.2: P (inter-picture predicted) is 0 and
+// B (start of frame) is 1 on the first packet of a keyframe.
+func isVP9Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	p := payload[0]&0x40 != 0
+	b := payload[0]&0x08 != 0
+	return !p && b
+}
+
+// RFC 6184: IDR or SPS NAL units, possibly inside STAP-A or FU-A packets.
+func isH264Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	switch nalType := payload[0] & 0x1F; nalType {
+	case 5, 7:
+		return true
+	case 24: // STAP-A
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			i += 2
+			if i >= len(payload) {
+				break
+			}
+			if t := payload[i] & 0x1F; t == 5 || t == 7 {
+				return true
+			}
+			i += size
+		}
+	case 28: // FU-A
+		if len(payload) < 2 {
+			return false
+		}
+		start := payload[1]&0x80 != 0
+		t := payload[1] & 0x1F
+		return start && (t == 5 || t == 7)
+	}
+	return false
+}
+
+// vp9Layer is the layer information of a VP9 packet.
+type vp9Layer struct {
+	sid   int  // spatial layer ID
+	start bool // B: first packet of the layer frame
+	end   bool // E: last packet of the layer frame
+}
+
+// parseVP9Layer reads the spatial layer from the VP9 payload descriptor.
+// ok is false when the packet carries no layer indices (no SVC).
+func parseVP9Layer(payload []byte) (vp9Layer, bool) {
+	if len(payload) < 1 {
+		return vp9Layer{}, false
+	}
+	i := payload[0]&0x80 != 0
+	l := payload[0]&0x20 != 0
+	layer := vp9Layer{
+		start: payload[0]&0x08 != 0,
+		end:   payload[0]&0x04 != 0,
+	}
+	if !l {
+		return layer, false
+	}
+
+	offset := 1
+	if i {
+		if len(payload) <= offset {
+			return layer, false
+		}
+		if payload[offset]&0x80 != 0 { // M: 15-bit picture ID
+			offset++
+		}
+		offset++
+	}
+	if len(payload) <= offset {
+		return layer, false
+	}
+	layer.sid = int(payload[offset]>>1) & 0x07
+	return layer, true
+}
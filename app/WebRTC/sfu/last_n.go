@@ -0,0 +1,180 @@
+package sfu
+
+import (
+	"log"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Last-N forwarding. With RoomConfig.LastN > 0 every peer only receives the
+// camera video of the N most recent active speakers, plus the pinned ones:
+// hosts, screen shares and the peers it pinned with `pin`. Audio always
+// goes to everyone. Hidden videos stay negotiated but paused (see
+// allocateLayers), so a speaker change only costs a keyframe.
+
+// dominantSpeakerHold is the minimum time a dominant speaker keeps the spot
+// while still speaking, so that short interjections do not steal it.
+const dominantSpeakerHold = 2 * time.Second
+
+// addSpeaker puts a new peer at the end of the speaker list, after the
+// ones that already spoke.
+func (r *Room) addSpeaker(peerID string) {
+	r.speakerMu.Lock()
+	defer r.speakerMu.Unlock()
+
+	for _, id := range r.speakers {
+		if id == peerID {
+			return
+		}
+	}
+	r.speakers = append(r.speakers, peerID)
+}
+
+func (r *Room) removeSpeaker(peerID string) {
+	r.speakerMu.Lock()
+	defer r.speakerMu.Unlock()
+
+	for i, id := range r.speakers {
+		if id == peerID {
+			r.speakers = append(r.speakers[:i], r.speakers[i+1:]...)
+			break
+		}
+	}
+	delete(r.levels, peerID)
+	if r.dominant == peerID {
+		r.dominant = ""
+	}
+}
+
+// SpeakerActive records that peer started speaking. It moves the peer to
+// the front of the speaker list, updates the dominant speaker and, when the
+// last-N set changes, re-applies video forwarding for everybody.
+func (r *Room) SpeakerActive(peer *Peer) {
+	now := time.Now()
+	// Checked before taking speakerMu, which nests inside r.mu
+	dominantSpeaking := r.isSpeaking(r.DominantSpeaker())
+
+	r.speakerMu.Lock()
+	index := -1
+	for i, id := range r.speakers {
+		if id == peer.id {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		r.speakerMu.Unlock()
+		return
+	}
+	copy(r.speakers[1:index+1], r.speakers[:index])
+	r.speakers[0] = peer.id
+
+	changedDominant := false
+	if r.dominant != peer.id && (r.dominant == "" || now.Sub(r.dominantAt) >= dominantSpeakerHold || !dominantSpeaking) {
+		r.dominant = peer.id
+		r.dominantAt = now
+		changedDominant = true
+	}
+	r.speakerMu.Unlock()
+
+	if changedDominant {
+		log.Printf("[ROOM %s] dominant speaker: %s", r.id, peer.id[:8])
+		r.BroadcastToAll(Signal{Type: "dominant_speaker", PeerID: peer.id, UserID: peer.userID})
+		// WHEP viewers switch their audio to the new dominant speaker
+		r.refreshFollowers()
+	}
+	// Peers already among the first N were visible to everybody
+	if r.cfg.LastN > 0 && index >= r.cfg.LastN {
+		r.refreshForwarding()
+	}
+}
+
+func (r *Room) isSpeaking(peerID string) bool {
+	peer := r.GetPeer(peerID)
+	if peer == nil {
+		return false
+	}
+	peer.stateMu.RLock()
+	defer peer.stateMu.RUnlock()
+	return peer.speaking
+}
+
+// DominantSpeaker returns the peer ID of the current dominant speaker.
+func (r *Room) DominantSpeaker() string {
+	r.speakerMu.Lock()
+	defer r.speakerMu.Unlock()
+	return r.dominant
+}
+
+// forwardsVideo reports whether the video track pub is forwarded to sub
+// under last-N.
+func (r *Room) forwardsVideo(sub *Peer, pub *PublishedTrack) bool {
+	if r.cfg.LastN <= 0 || pub.kind != webrtc.RTPCodecTypeVideo || pub.media == mediaScreen {
+		return true
+	}
+	if pub.publisher != nil && pub.publisher.role == RoleHost {
+		return true
+	}
+	if sub.isPinned(pub.publisherID) {
+		return true
+	}
+
+	r.speakerMu.Lock()
+	defer r.speakerMu.Unlock()
+
+	n := 0
+	for _, id := range r.speakers {
+		if id == sub.id {
+			continue
+		}
+		if id == pub.publisherID {
+			return true
+		}
+		n++
+		if n >= r.cfg.LastN {
+			break
+		}
+	}
+	return false
+}
+
+// refreshForwarding re-applies last-N for every peer without waiting for
+// their next allocation tick.
+func (r *Room) refreshForwarding() {
+	r.mu.RLock()
+	peers := make([]*Peer, 0, len(r.peers))
+	for _, peer := range r.peers {
+		peers = append(peers, peer)
+	}
+	r.mu.RUnlock()
+
+	for _, peer := range peers {
+		go peer.allocateLayers()
+	}
+}
+
+func (p *Peer) isPinned(peerID string) bool {
+	p.stateMu.RLock()
+	defer p.stateMu.RUnlock()
+	return p.pinned[peerID]
+}
+
+// handlePin implements `pin`/`unpin`: the video of msg.PeerID is received
+// regardless of last-N.
+func (p *Peer) handlePin(msg Signal) {
+	if msg.PeerID == "" || msg.PeerID == p.id {
+		return
+	}
+
+	p.stateMu.Lock()
+	if msg.Type == "pin" {
+		p.pinned[msg.PeerID] = true
+	} else {
+		delete(p.pinned, msg.PeerID)
+	}
+	p.stateMu.Unlock()
+
+	log.Printf("[PEER %s] %s %s", p.id[:8], msg.Type, msg.PeerID)
+	go p.allocateLayers()
+}
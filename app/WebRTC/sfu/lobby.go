@@ -0,0 +1,169 @@
+package sfu
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+var ErrRoomFull = errors.New("room_full")
+
+// Join adds an admitted peer to the room and sends the initial signals:
+// peer_list to the newcomer, peer_joined to everybody and joined last.
+func (r *Room) Join(peer *Peer) error {
+	if err := r.AddPeer(peer); err != nil {
+		return err
+	}
+
+	_ = peer.Send(Signal{Type: "peer_list", Users: r.SnapshotUsers(peer.id), Hands: r.HandQueue()})
+	info := peer.userInfo()
+	// Broadcast peer_joined to all peers including originator for consistency
+	r.BroadcastToAll(Signal{Type: "peer_joined", PeerID: info.PeerID, UserID: info.UserID, UserName: info.UserName, Role: info.Role, AudioEnabled: info.AudioEnabled, VideoEnabled: info.VideoEnabled, ScreenEnabled: info.ScreenEnabled, Speaking: info.Speaking})
+	joined := Signal{Type: "joined", PeerID: peer.id, Role: string(peer.role), AudioAllowed: peer.canPublish(mediaAudio), VideoAllowed: peer.canPublish(mediaVideo), ICEServers: r.cfg.ICE.serversFor(peer.userID, time.Now())}
+	if peer.resumable() {
+		joined.ResumeToken = peer.currentResumeToken()
+		joined.ResumeGrace = r.cfg.ResumeGrace.Milliseconds()
+	}
+	_ = peer.Send(joined)
+	if history := r.chat.recent(r.cfg.Chat.Replay); len(history) > 0 {
+		_ = peer.Send(Signal{Type: "chat_history", Messages: history})
+	}
+	r.sendRoomState(peer)
+
+	if peer.isHost() {
+		r.sendLobbyUpdate()
+	}
+	return nil
+}
+
+// sendRoomState sends peer the state of the room that is not in peer_list.
+func (r *Room) sendRoomState(peer *Peer) {
+	if r.IsRecording() {
+		_ = peer.Send(Signal{Type: "recording_started"})
+	}
+	for _, msg := range r.egressSignals() {
+		_ = peer.Send(msg)
+	}
+	if viewers := r.ViewerCount(); viewers > 0 {
+		_ = peer.Send(Signal{Type: "viewers", Count: viewers})
+	}
+	if dominant := r.GetPeer(r.DominantSpeaker()); dominant != nil {
+		_ = peer.Send(Signal{Type: "dominant_speaker", PeerID: dominant.id, UserID: dominant.userID})
+	}
+}
+
+// IsFull reports whether a peer with the given role would be refused.
+// Hosts are never kept out by the participant limit.
+func (r *Room) IsFull(role Role) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.isFullLocked(role)
+}
+
+func (r *Room) isFullLocked(role Role) bool {
+	return role != RoleHost && r.cfg.MaxParticipants > 0 && len(r.peers) >= r.cfg.MaxParticipants
+}
+
+// canAddPublisherLocked reports whether publisherID may start publishing
+// without exceeding MaxPublishers.
+func (r *Room) canAddPublisherLocked(publisherID string) bool {
+	if r.cfg.MaxPublishers <= 0 {
+		return true
+	}
+	publishers := map[string]bool{}
+	for _, pub := range r.published {
+		publishers[pub.publisherID] = true
+	}
+	return publishers[publisherID] || len(publishers) < r.cfg.MaxPublishers
+}
+
+// UsesLobby reports whether a peer with the given role has to wait for a
+// host to admit it.
+func (r *Room) UsesLobby(role Role) bool {
+	return r.cfg.Lobby && role != RoleHost
+}
+
+// EnterLobby parks peer in the waiting room and notifies the hosts.
+func (r *Room) EnterLobby(peer *Peer) {
+	r.mu.Lock()
+	r.lobby[peer.id] = peer
+	r.mu.Unlock()
+
+	log.Printf("[ROOM %s] peer %s waiting in lobby", r.id, peer.id[:8])
+	_ = peer.Send(Signal{Type: "waiting", PeerID: peer.id})
+	r.sendLobbyUpdate()
+}
+
+// LeaveLobby removes peer from the waiting room, if it is there.
+func (r *Room) LeaveLobby(peerID string) *Peer {
+	r.mu.Lock()
+	peer := r.lobby[peerID]
+	delete(r.lobby, peerID)
+	r.mu.Unlock()
+
+	if peer != nil {
+		r.sendLobbyUpdate()
+	}
+	return peer
+}
+
+// LobbyPeer returns the peer peerID waiting in the lobby, if any.
+func (r *Room) LobbyPeer(peerID string) *Peer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.lobby[peerID]
+}
+
+func (r *Room) sendLobbyUpdate() {
+	r.mu.RLock()
+	waiting := make([]UserInfo, 0, len(r.lobby))
+	for _, peer := range r.lobby {
+		waiting = append(waiting, UserInfo{PeerID: peer.id, UserID: peer.userID, UserName: peer.userName, Role: string(peer.role)})
+	}
+	hosts := make([]*Peer, 0)
+	for _, peer := range r.peers {
+		if peer.isHost() {
+			hosts = append(hosts, peer)
+		}
+	}
+	r.mu.RUnlock()
+
+	for _, host := range hosts {
+		_ = host.Send(Signal{Type: "lobby_update", Users: waiting})
+	}
+}
+
+// handleAdmission implements the host `admit` and `deny` commands.
+func (p *Peer) handleAdmission(msg Signal) {
+	if !p.isHost() {
+		p.sendError("not allowed: host only")
+		return
+	}
+
+	waiting := p.room.LeaveLobby(msg.PeerID)
+	if waiting == nil {
+		p.sendError("unknown peer")
+		return
+	}
+
+	if msg.Type == "deny" {
+		log.Printf("[PEER %s] denied %s", p.id[:8], waiting.id[:8])
+		waiting.SendAndClose(Signal{Type: "error", Message: "admission denied"})
+		return
+	}
+
+	// Banned while waiting, or before entering with another connection
+	if p.room.IsBanned(waiting.userID) {
+		log.Printf("[PEER %s] refused to admit banned user=%s", p.id[:8], waiting.userID)
+		p.sendError("banned")
+		waiting.SendAndClose(Signal{Type: "banned", PeerID: waiting.id, UserID: waiting.userID})
+		return
+	}
+
+	log.Printf("[PEER %s] admitted %s", p.id[:8], waiting.id[:8])
+	waiting.setWaiting(false)
+	if err := p.room.Join(waiting); err != nil {
+		p.sendError(err.Error())
+		waiting.SendAndClose(Signal{Type: "error", Message: err.Error()})
+	}
+}
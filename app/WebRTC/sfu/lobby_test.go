@@ -0,0 +1,27 @@
+package sfu
+
+import "testing"
+
+func TestBanEmptiesLobby(t *testing.T) {
+	cfg := DefaultConfig().Rooms
+	cfg.Lobby = true
+	room := NewRoom("lesson-1", cfg, func(*Room) {}, func(*Room) {})
+	waiting := &Peer{id: "waiting-peer-01", userID: "42", role: RoleStudent}
+	other := &Peer{id: "other-peer-0001", userID: "43", role: RoleStudent}
+	room.lobby[waiting.id] = waiting
+	room.lobby[other.id] = other
+
+	if room.LobbyPeer(waiting.id) != waiting {
+		t.Fatal("lobby peer not found by peer ID")
+	}
+	banned := room.Ban("42")
+	if len(banned) != 1 || banned[0] != waiting {
+		t.Fatalf("Ban returned %v, want the waiting peer", banned)
+	}
+	if room.LobbyPeer(waiting.id) != nil || room.LobbyPeer(other.id) != other {
+		t.Fatal("Ban did not take only the banned user out of the lobby")
+	}
+	if !room.IsBanned("42") {
+		t.Fatal("user not banned")
+	}
+}
@@ -0,0 +1,80 @@
+package sfu
+
+import "log"
+
+// handleModeration implements the host-only commands `mute_peer`,
+// `disable_video`, `kick_peer` and `ban_user`. The target is given by
+// peerId; `ban_user` also accepts the peerId of a peer waiting in the lobby,
+// or a userId for users that are not connected.
+func (p *Peer) handleModeration(msg Signal) {
+	if !p.isHost() {
+		p.sendError("not allowed: host only")
+		return
+	}
+
+	target := p.room.GetPeer(msg.PeerID)
+	if target == p {
+		p.sendError("cannot moderate yourself")
+		return
+	}
+
+	if msg.Type == "ban_user" {
+		if target == nil && msg.PeerID != "" {
+			target = p.room.LobbyPeer(msg.PeerID)
+		}
+		userID := msg.UserID
+		if target != nil {
+			userID = target.userID
+		}
+		if userID == "" || userID == p.userID {
+			p.sendError("invalid ban target")
+			return
+		}
+		log.Printf("[PEER %s] banning user=%s from room %s", p.id[:8], userID, p.room.id)
+		for _, banned := range p.room.Ban(userID) {
+			banned.SendAndClose(Signal{Type: "banned", PeerID: banned.id, UserID: banned.userID})
+		}
+		return
+	}
+
+	if target == nil {
+		p.sendError("unknown peer")
+		return
+	}
+
+	log.Printf("[PEER %s] %s on peer %s", p.id[:8], msg.Type, target.id[:8])
+	switch msg.Type {
+	case "mute_peer":
+		target.forceStop(mediaAudio)
+		_ = target.Send(Signal{Type: "muted", PeerID: target.id, TrackKind: mediaAudio})
+	case "disable_video":
+		target.forceStop(mediaVideo)
+		_ = target.Send(Signal{Type: "video_disabled", PeerID: target.id, TrackKind: mediaVideo})
+	case "kick_peer":
+		target.SendAndClose(Signal{Type: "kicked", PeerID: target.id})
+	}
+}
+
+// forceStop removes every published track of kind ("audio" or "video",
+// which includes screen share) and tells the room the media is off.
+func (p *Peer) forceStop(kind string) {
+	p.stateMu.Lock()
+	if kind == mediaAudio {
+		p.audioEnabled = false
+		p.speaking = false
+	} else {
+		p.videoEnabled = false
+		p.screenEnabled = false
+		p.screenStreamID = ""
+	}
+	p.stateMu.Unlock()
+
+	p.room.RemovePublishedTracksByKind(p.id, kind)
+	p.room.BroadcastToAll(Signal{
+		Type:      "track_removed",
+		PeerID:    p.id,
+		UserID:    p.userID,
+		TrackKind: kind,
+	})
+	p.broadcastMediaState()
+}
@@ -0,0 +1,138 @@
+package sfu
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// NetworkConfig controls the addresses and ports of the SFU's own ICE
+// candidates. By default every PeerConnection binds its own ephemeral UDP
+// ports on every interface, which firewalls that open a few ports do not
+// allow.
+type NetworkConfig struct {
+	// UDPPort muxes the ICE traffic of every PeerConnection through a
+	// single UDP port (0 = ephemeral ports).
+	UDPPort int `yaml:"udpPort" env:"ICE_UDP_PORT"`
+	// TCPPort accepts ICE-TCP, a fallback for clients whose UDP is blocked
+	// (0 = off).
+	TCPPort int `yaml:"tcpPort" env:"ICE_TCP_PORT"`
+	// NAT1To1IPs are the public IPs of a VM behind 1:1 NAT (cloud elastic
+	// IPs). They replace the private addresses in the host candidates.
+	NAT1To1IPs []string `yaml:"nat1to1Ips" env:"NAT_1TO1_IPS"`
+	// Interfaces limits the candidates to these interface names
+	// (empty = all), e.g. to leave out docker0.
+	Interfaces []string `yaml:"interfaces" env:"ICE_INTERFACES"`
+	// Networks limits the candidates to addresses in these CIDRs or IPs
+	// (empty = all).
+	Networks []string `yaml:"networks" env:"ICE_NETWORKS"`
+}
+
+// settingEngine builds the SettingEngine of the WebRTC API and opens the
+// mux listeners, which live as long as the server.
+func (c NetworkConfig) settingEngine() (webrtc.SettingEngine, error) {
+	var settings webrtc.SettingEngine
+
+	interfaceFilter := c.interfaceFilter()
+	ipFilter, err := c.ipFilter()
+	if err != nil {
+		return settings, err
+	}
+	if interfaceFilter != nil {
+		settings.SetInterfaceFilter(interfaceFilter)
+	}
+	if ipFilter != nil {
+		settings.SetIPFilter(ipFilter)
+	}
+
+	if len(c.NAT1To1IPs) > 0 {
+		for _, ip := range c.NAT1To1IPs {
+			if net.ParseIP(ip) == nil {
+				return settings, fmt.Errorf("invalid NAT 1:1 IP %q", ip)
+			}
+		}
+		settings.SetNAT1To1IPs(c.NAT1To1IPs, webrtc.ICECandidateTypeHost)
+	}
+
+	if c.UDPPort > 0 {
+		var opts []ice.UDPMuxFromPortOption
+		if interfaceFilter != nil {
+			opts = append(opts, ice.UDPMuxFromPortWithInterfaceFilter(interfaceFilter))
+		}
+		if ipFilter != nil {
+			opts = append(opts, ice.UDPMuxFromPortWithIPFilter(ipFilter))
+		}
+		mux, err := ice.NewMultiUDPMuxFromPort(c.UDPPort, opts...)
+		if err != nil {
+			return settings, fmt.Errorf("ICE UDP port %d: %w", c.UDPPort, err)
+		}
+		settings.SetICEUDPMux(mux)
+		log.Printf("ICE UDP mux listening on port %d", c.UDPPort)
+	}
+
+	if c.TCPPort > 0 {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: c.TCPPort})
+		if err != nil {
+			return settings, fmt.Errorf("ICE TCP port %d: %w", c.TCPPort, err)
+		}
+		settings.SetICETCPMux(webrtc.NewICETCPMux(nil, listener, 8))
+		// pion only gathers UDP unless asked
+		settings.SetNetworkTypes([]webrtc.NetworkType{
+			webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6,
+			webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6,
+		})
+		log.Printf("ICE TCP listening on port %d", c.TCPPort)
+	}
+
+	return settings, nil
+}
+
+func (c NetworkConfig) interfaceFilter() func(string) bool {
+	if len(c.Interfaces) == 0 {
+		return nil
+	}
+	allowed := make(map[string]bool, len(c.Interfaces))
+	for _, name := range c.Interfaces {
+		allowed[strings.TrimSpace(name)] = true
+	}
+	return func(name string) bool { return allowed[name] }
+}
+
+func (c NetworkConfig) ipFilter() (func(net.IP) bool, error) {
+	if len(c.Networks) == 0 {
+		return nil, nil
+	}
+	var networks []*net.IPNet
+	for _, s := range c.Networks {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			s += "/" + strconv.Itoa(bits)
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", s)
+		}
+		networks = append(networks, network)
+	}
+	return func(ip net.IP) bool {
+		for _, network := range networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
 )
 
@@ -15,8 +16,9 @@ type Peer struct {
 	id        string
 	userID    string
 	userName  string
+	role      Role
 	room      *Room
-	ws        *websocket.Conn
+	ws        *websocket.Conn // nil for WHIP publishers, which have no signaling channel; swapped on resume
 	api       *webrtc.API
 	pubPC     *webrtc.PeerConnection
 	subPC     *webrtc.PeerConnection
@@ -25,119 +27,184 @@ type Peer struct {
 	closeOnce sync.Once
 
 	subscriptions map[string]*webrtc.RTPSender
+	bwe           *bandwidthEstimator
 	stateMu       sync.RWMutex // Protege: audioEnabled, videoEnabled, screenEnabled, speaking
 	audioEnabled  bool
 	videoEnabled  bool
 	screenEnabled bool
 	screenStreamID string
 	speaking      bool
+	serverVAD     bool // speaking is detected from audio levels, see audio_level.go
+	videoAllowed  bool // students only publish video when allowed by a host
+	audioAllowed  bool // false keeps students silent unless called on
+	audioGranted  bool // called on from the hand-raise queue, see hand_queue.go
+	pinned        map[string]bool // peer IDs whose video is always received (last-N)
+	waiting       bool // held in the lobby, signals are ignored
 	subReady      bool
 
 	subNegotiationMu   sync.Mutex
 	pendingSubNegotiation bool
+	restartSubICE      bool // next sub_offer restarts ICE, see resume.go and ice_restart.go
+
+	iceMu   sync.Mutex // Protege: iceDown
+	iceDown map[string]*iceRecovery // "pub"/"sub" PeerConnections that lost connectivity
+
+	// Session resumption, see resume.go
+	connMu      sync.Mutex // Protege: ws, connGen, connDone, detached, resumed, expired, resumeToken
+	connGen     int
+	connDone    chan struct{} // closed when the current connection ends
+	detached    bool
+	resumed     chan struct{} // closed when a detached peer is resumed
+	expired     bool
+	resumeToken string
+	whipSecret  string // in the resource URL of WHIP publishers, see whip.go
+
+	// Chat, reactions and hands, see datachannel.go
+	dataChannels map[string]*webrtc.DataChannel // by label, fixed after NewPeer
+	dataMu       sync.Mutex // Protege: dataBuckets
+	dataBuckets  map[string]*tokenBucket
 }
 
-func NewPeer(id, userID, userName string, room *Room, ws *websocket.Conn, api *webrtc.API) (*Peer, error) {
-	pubPC, err := api.NewPeerConnection(webrtc.Configuration{})
-	if err != nil {
-		return nil, err
-	}
+func NewPeer(id, userID, userName string, role Role, audioAllowed, videoAllowed bool, room *Room, ws *websocket.Conn, api *webrtc.API) (*Peer, error) {
+	// Observers are subscribe-only and never get a pub PeerConnection
+	var pubPC *webrtc.PeerConnection
+	if role != RoleObserver {
+		var err error
+		pubPC, err = api.NewPeerConnection(room.cfg.ICE.peerConnectionConfig())
+		if err != nil {
+			return nil, err
+		}
 
-	if _, err := pubPC.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
-		Direction: webrtc.RTPTransceiverDirectionRecvonly,
-	}); err != nil {
-		return nil, err
-	}
-	if _, err := pubPC.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
-		Direction: webrtc.RTPTransceiverDirectionRecvonly,
-	}); err != nil {
-		return nil, err
+		if _, err := pubPC.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		}); err != nil {
+			return nil, err
+		}
+		if _, err := pubPC.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		}); err != nil {
+			return nil, err
+		}
 	}
 
-	subPC, err := api.NewPeerConnection(webrtc.Configuration{})
-	if err != nil {
-		return nil, err
+	// WHIP publishers only publish, they never get a sub PeerConnection
+	var subPC *webrtc.PeerConnection
+	if ws != nil {
+		var err error
+		subPC, err = api.NewPeerConnection(room.cfg.ICE.peerConnectionConfig())
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	peer := &Peer{
 		id:            id,
 		userID:        userID,
 		userName:      userName,
+		role:          role,
 		room:          room,
 		ws:            ws,
 		api:           api,
 		pubPC:         pubPC,
 		subPC:         subPC,
-		send:          make(chan []byte, 32),
+		send:          make(chan []byte, room.cfg.signaling.SendBuffer),
 		closed:        make(chan struct{}),
 		subscriptions: map[string]*webrtc.RTPSender{},
-		audioEnabled:  true,
-		videoEnabled:  true,
+		bwe:           newBandwidthEstimator(),
+		audioEnabled:  role == RoleHost || (role == RoleStudent && audioAllowed),
+		videoEnabled:  role == RoleHost || (role == RoleStudent && videoAllowed),
 		screenEnabled: false,
 		speaking:      false,
+		videoAllowed:  videoAllowed,
+		audioAllowed:  audioAllowed,
+		pinned:        map[string]bool{},
 		subReady:      false,
+		dataChannels:  map[string]*webrtc.DataChannel{},
+		connDone:      make(chan struct{}),
+		dataBuckets:   map[string]*tokenBucket{},
+		iceDown:       map[string]*iceRecovery{},
 	}
 
-	pubPC.OnICECandidate(func(c *webrtc.ICECandidate) {
+	if ws != nil {
+		peer.resumeToken = randomHex(16)
+	} else {
+		peer.whipSecret = randomHex(16)
+	}
+	if pubPC != nil {
+		peer.setupPubPC()
+	}
+	if subPC != nil {
+		peer.setupSubPC()
+		if err := peer.setupDataChannels(); err != nil {
+			return nil, err
+		}
+	}
+	return peer, nil
+}
+
+// setupSubPC wires the callbacks of the subscribing PeerConnection.
+func (p *Peer) setupSubPC() {
+	p.subPC.OnICECandidate(func(c *webrtc.ICECandidate) {
 		if c == nil {
 			return
 		}
 		candidate := c.ToJSON()
-		_ = peer.Send(Signal{
+		_ = p.Send(Signal{
 			Type:          "candidate",
-			Target:        "pub",
+			Target:        "sub",
 			Candidate:     candidate.Candidate,
 			SDPMid:        valueOrEmpty(candidate.SDPMid),
 			SDPMLineIndex: valueOrZero(candidate.SDPMLineIndex),
 		})
 	})
 
-	subPC.OnICECandidate(func(c *webrtc.ICECandidate) {
+	p.subPC.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		p.onConnectionStateChange("sub", state)
+	})
+}
+
+// setupPubPC wires the callbacks of the publishing PeerConnection.
+func (p *Peer) setupPubPC() {
+	p.pubPC.OnICECandidate(func(c *webrtc.ICECandidate) {
 		if c == nil {
 			return
 		}
 		candidate := c.ToJSON()
-		_ = peer.Send(Signal{
+		_ = p.Send(Signal{
 			Type:          "candidate",
-			Target:        "sub",
+			Target:        "pub",
 			Candidate:     candidate.Candidate,
 			SDPMid:        valueOrEmpty(candidate.SDPMid),
 			SDPMLineIndex: valueOrZero(candidate.SDPMLineIndex),
 		})
 	})
 
-	pubPC.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-		switch state {
-		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateClosed:
-			peer.Close()
-		}
+	p.pubPC.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		p.onConnectionStateChange("pub", state)
 	})
 
-	subPC.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-		switch state {
-		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateClosed:
-			peer.Close()
-		}
+	p.pubPC.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		p.room.AddPublishedTrack(p, track, receiver)
 	})
-
-	pubPC.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
-		peer.room.AddPublishedTrack(peer, track)
-	})
-
-	return peer, nil
 }
 
 func (p *Peer) Start() {
-	go p.writeLoop()
+	p.connMu.Lock()
+	if p.ws != nil {
+		go p.writeLoop(p.ws, p.connDone)
+	}
+	p.connMu.Unlock()
+	go p.allocateLoop()
 }
 
 func (p *Peer) Done() <-chan struct{} {
 	return p.closed
 }
 
-func (p *Peer) ReadLoop() {
+// ReadLoop handles the signals received on conn until it fails.
+func (p *Peer) ReadLoop(conn *websocket.Conn) {
 	for {
-		_, data, err := p.ws.ReadMessage()
+		_, data, err := conn.ReadMessage()
 		if err != nil {
 			return
 		}
@@ -152,6 +219,16 @@ func (p *Peer) ReadLoop() {
 }
 
 func (p *Peer) Send(msg Signal) error {
+	p.connMu.Lock()
+	ws, detached := p.ws, p.detached
+	p.connMu.Unlock()
+	if ws == nil {
+		return nil
+	}
+	if detached {
+		// Lost, the resume snapshot replaces it
+		return errPeerDetached
+	}
 	data, err := json.Marshal(msg)
 	if err != nil {
 		log.Printf("[PEER %s] JSON marshal error: %v", p.id[:8], err)
@@ -167,16 +244,42 @@ func (p *Peer) Send(msg Signal) error {
 	}
 }
 
+// SendAndClose delivers a last signal (e.g. `kicked`) and closes the peer
+// once it has been written, or after WriteWait if the socket is stuck.
+func (p *Peer) SendAndClose(msg Signal) {
+	if err := p.Send(msg); err != nil {
+		p.Close()
+		return
+	}
+	select {
+	case p.send <- nil: // nil tells writeLoop to close after flushing
+	case <-p.closed:
+		return
+	}
+	time.AfterFunc(p.room.cfg.signaling.WriteWait, p.Close)
+}
+
 func (p *Peer) Close() {
 	p.closeOnce.Do(func() {
 		close(p.closed)
-		_ = p.pubPC.Close()
-		_ = p.subPC.Close()
-		_ = p.ws.Close()
+		if p.pubPC != nil {
+			_ = p.pubPC.Close()
+		}
+		if p.subPC != nil {
+			_ = p.subPC.Close()
+		}
+		p.connMu.Lock()
+		if p.ws != nil {
+			_ = p.ws.Close()
+		}
+		p.connMu.Unlock()
 	})
 }
 
 func (p *Peer) AddSubscription(pub *PublishedTrack) error {
+	if p.subPC == nil {
+		return errPublishOnly
+	}
 	localTrack, err := webrtc.NewTrackLocalStaticRTP(pub.codec, pub.trackID, pub.streamID)
 	if err != nil {
 		return err
@@ -187,9 +290,11 @@ func (p *Peer) AddSubscription(pub *PublishedTrack) error {
 		return err
 	}
 
+	hidden := pub.kind == webrtc.RTPCodecTypeVideo && !p.room.forwardsVideo(p, pub)
 	p.subscriptions[pub.key] = sender
-	pub.AddSubscriber(p.id, localTrack)
-	go p.readRTCP(sender)
+	pub.AddSubscriber(p.id, localTrack, hidden)
+	p.bwe.add(pub.key, pub, hidden)
+	go p.readRTCP(sender, pub)
 	return nil
 }
 
@@ -200,6 +305,7 @@ func (p *Peer) RemoveSubscription(key string) {
 	}
 	_ = p.subPC.RemoveTrack(sender)
 	delete(p.subscriptions, key)
+	p.bwe.remove(key)
 	p.negotiateSub()
 }
 
@@ -216,13 +322,14 @@ func (p *Peer) negotiateSub() {
 		return
 	}
 
-	offer, err := p.subPC.CreateOffer(nil)
+	offer, err := p.subPC.CreateOffer(&webrtc.OfferOptions{ICERestart: p.restartSubICE})
 	if err != nil {
 		return
 	}
 	if err := p.subPC.SetLocalDescription(offer); err != nil {
 		return
 	}
+	p.restartSubICE = false
 	_ = p.Send(Signal{Type: "sub_offer", SDP: offer.SDP})
 }
 
@@ -237,10 +344,27 @@ func (p *Peer) flushSubNegotiation() {
 	}
 }
 
+func (p *Peer) setWaiting(waiting bool) {
+	p.stateMu.Lock()
+	p.waiting = waiting
+	p.stateMu.Unlock()
+}
+
 func (p *Peer) handleSignal(msg Signal) {
 	log.Printf("[PEER %s] received signal: type=%s", p.id[:8], msg.Type)
+	p.stateMu.RLock()
+	waiting := p.waiting
+	p.stateMu.RUnlock()
+	if waiting {
+		return
+	}
+
 	switch msg.Type {
 	case "pub_offer":
+		if p.pubPC == nil {
+			p.sendError("not allowed to publish")
+			return
+		}
 		if msg.SDP != "" {
 			p.handlePubOffer(msg.SDP)
 		}
@@ -253,30 +377,29 @@ func (p *Peer) handleSignal(msg Signal) {
 			p.handleCandidate(msg)
 		}
 	case "sub_ready":
+		p.subNegotiationMu.Lock()
 		p.subReady = true
+		p.subNegotiationMu.Unlock()
 		p.flushSubNegotiation()
 	case "media_state":
+		// Never advertise media the peer is not allowed to publish
+		audio := msg.AudioEnabled && p.canPublish(mediaAudio)
+		video := msg.VideoEnabled && p.canPublish(mediaVideo)
+		screen := msg.ScreenEnabled && p.canPublish(mediaScreen)
 		p.stateMu.Lock()
-		p.audioEnabled = msg.AudioEnabled
-		p.videoEnabled = msg.VideoEnabled
-		p.screenEnabled = msg.ScreenEnabled
+		p.audioEnabled = audio
+		p.videoEnabled = video
+		p.screenEnabled = screen
 		p.stateMu.Unlock()
 		log.Printf("[PEER %s] media_state received: audio=%v video=%v screen=%v", p.id[:8], msg.AudioEnabled, msg.VideoEnabled, msg.ScreenEnabled)
 		// Keep published tracks alive when toggling media so resume works reliably.
 		// Broadcast to ALL peers including the originator so they all stay in sync
-		p.stateMu.RLock()
-		broadcast := Signal{
-			Type:          "media_state",
-			PeerID:        p.id,
-			UserID:        p.userID,
-			AudioEnabled:  p.audioEnabled,
-			VideoEnabled:  p.videoEnabled,
-			ScreenEnabled: p.screenEnabled,
-		}
-		p.stateMu.RUnlock()
-		log.Printf("[PEER %s] broadcasting media_state: %+v", p.id[:8], broadcast)
-		p.room.BroadcastToAll(broadcast)
+		p.broadcastMediaState()
 	case "screen_stream":
+		if msg.ScreenEnabled && !p.canPublish(mediaScreen) {
+			p.sendError("not allowed to share screen")
+			return
+		}
 		p.stateMu.Lock()
 		p.screenStreamID = msg.ScreenStreamID
 		enabled := msg.ScreenEnabled
@@ -293,16 +416,11 @@ func (p *Peer) handleSignal(msg Signal) {
 			ScreenStreamID: p.screenStreamID,
 		})
 	case "speaking":
-		p.stateMu.Lock()
-		p.speaking = msg.Speaking
-		p.stateMu.Unlock()
-		// Broadcast to ALL peers including the originator
-		p.room.BroadcastToAll(Signal{
-			Type:    "speaking",
-			PeerID:  p.id,
-			UserID:  p.userID,
-			Speaking: p.speaking,
-		})
+		// Client reports are only a fallback for audio without levels
+		if p.usesServerVAD() {
+			return
+		}
+		p.setSpeaking(msg.Speaking)
 	case "track_removed":
 		// Broadcast to ALL peers including the originator
 		log.Printf("[PEER %s] track_removed: trackKind=%s streamId=%s", p.id[:8], msg.TrackKind, msg.StreamID)
@@ -317,14 +435,55 @@ func (p *Peer) handleSignal(msg Signal) {
 		if msg.StreamID != "" {
 			p.room.RemovePublishedTrack(p.id, msg.StreamID)
 		}
+	case "promote":
+		p.handleSetVideoAllowed(msg, true)
+	case "demote":
+		p.handleSetVideoAllowed(msg, false)
+	case "mute_peer", "disable_video", "kick_peer", "ban_user":
+		p.handleModeration(msg)
+	case "admit", "deny":
+		p.handleAdmission(msg)
+	case "set_layer":
+		if msg.StreamID != "" {
+			p.room.SetLayer(p.id, msg.StreamID, msg.Layer)
+		}
+	case "pin", "unpin":
+		p.handlePin(msg)
+	case "raise_hand", "lower_hand", "call_on", "dismiss":
+		p.handleHands(msg)
+	case "start_recording", "stop_recording":
+		p.handleRecording(msg)
+	case "start_egress", "stop_egress":
+		p.handleEgress(msg)
 	}
 }
 
+func (p *Peer) broadcastMediaState() {
+	p.stateMu.RLock()
+	broadcast := Signal{
+		Type:          "media_state",
+		PeerID:        p.id,
+		UserID:        p.userID,
+		AudioEnabled:  p.audioEnabled,
+		VideoEnabled:  p.videoEnabled,
+		ScreenEnabled: p.screenEnabled,
+	}
+	p.stateMu.RUnlock()
+	log.Printf("[PEER %s] broadcasting media_state: %+v", p.id[:8], broadcast)
+	p.room.BroadcastToAll(broadcast)
+}
+
+func (p *Peer) sendError(message string) {
+	log.Printf("[PEER %s] error: %s", p.id[:8], message)
+	_ = p.Send(Signal{Type: "error", Message: message})
+}
+
 func (p *Peer) userInfo() UserInfo {
 	return UserInfo{
 		PeerID:        p.id,
 		UserName:      p.userName,
 		UserID:        p.userID,
+		Role:          string(p.role),
 		AudioEnabled:  p.audioEnabled,
 		VideoEnabled:  p.videoEnabled,
 		ScreenEnabled: p.screenEnabled,
@@ -379,37 +538,67 @@ func (p *Peer) handleCandidate(msg Signal) {
 		_ = p.subPC.AddICECandidate(candidate)
 		return
 	}
-	_ = p.pubPC.AddICECandidate(candidate)
+	if p.pubPC != nil {
+		_ = p.pubPC.AddICECandidate(candidate)
+	}
 }
 
-func (p *Peer) writeLoop() {
-	ticker := time.NewTicker(pingPeriod)
+// writeLoop writes the queued signals to conn until done is closed (the
+// connection ended) or the peer is closed.
+func (p *Peer) writeLoop(conn *websocket.Conn, done <-chan struct{}) {
+	signaling := p.room.cfg.signaling
+	ticker := time.NewTicker(signaling.pingPeriod())
 	defer ticker.Stop()
 	for {
 		select {
 		case data := <-p.send:
-			_ = p.ws.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := p.ws.WriteMessage(websocket.TextMessage, data); err != nil {
+			if data == nil {
+				p.Close()
+				return
+			}
+			_ = conn.SetWriteDeadline(time.Now().Add(signaling.WriteWait))
+			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
 				log.Printf("[PEER %s] WriteMessage error: %v", p.id[:8], err)
 				return
 			}
 		case <-ticker.C:
-			_ = p.ws.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := p.ws.WriteMessage(websocket.PingMessage, []byte("ping")); err != nil {
+			_ = conn.SetWriteDeadline(time.Now().Add(signaling.WriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, []byte("ping")); err != nil {
 				return
 			}
+		case <-done:
+			return
 		case <-p.closed:
 			return
 		}
 	}
 }
 
-func (p *Peer) readRTCP(sender *webrtc.RTPSender) {
-	buf := make([]byte, 1500)
+// readRTCP consumes the feedback of a subscriber for one forwarded track:
+// keyframe requests go to the publisher, the rest feeds bandwidth estimation.
+func (p *Peer) readRTCP(sender *webrtc.RTPSender, pub *PublishedTrack) {
 	for {
-		if _, _, err := sender.Read(buf); err != nil {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
 			return
 		}
+		for _, packet := range packets {
+			switch pkt := packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				pub.RequestKeyframe()
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				p.bwe.onREMB(uint64(pkt.Bitrate))
+			case *rtcp.ReceiverReport:
+				for _, report := range pkt.Reports {
+					p.bwe.onLoss(float64(report.FractionLost) / 256)
+				}
+			case *rtcp.TransportLayerCC:
+				if pkt.PacketStatusCount > 0 {
+					lost := int(pkt.PacketStatusCount) - len(pkt.RecvDeltas)
+					p.bwe.onLoss(float64(lost) / float64(pkt.PacketStatusCount))
+				}
+			}
+		}
 	}
 }
 
@@ -2,6 +2,9 @@ package sfu
 
 import (
 	"fmt"
+	"log"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -10,21 +13,85 @@ import (
 	"github.com/pion/webrtc/v3"
 )
 
+// PublishedTrack is a track published by a peer. A simulcast publish has
+// one layer per RID, all grouped under the same key; a regular publish has
+// a single layer with an empty RID. Each subscriber receives one layer.
 type PublishedTrack struct {
 	key         string
 	publisherID string
 	publisher   *Peer
 	trackID     string
 	streamID    string
+	kind        webrtc.RTPCodecType
+	media       string // mediaAudio, mediaVideo or mediaScreen
 	codec       webrtc.RTPCodecCapability
-	remote      *webrtc.TrackRemote
 
 	mu          sync.RWMutex
-	subscribers map[string]*webrtc.TrackLocalStaticRTP
+	layers      []*trackLayer  // ordered from lowest to highest quality
+	spatial     []bitrateMeter // VP9 SVC: one meter per spatial layer seen
+	audioLevel  audioLevelDetector
+	subscribers map[string]*trackSubscriber
+	started     bool
 	done        chan struct{}
 }
 
-func NewPublishedTrack(publisher *Peer, track *webrtc.TrackRemote) *PublishedTrack {
+type trackLayer struct {
+	rid     string
+	remote  *webrtc.TrackRemote
+	bitrate bitrateMeter
+}
+
+// bitrateMeter measures a bitrate over windows of about one second.
+type bitrateMeter struct {
+	bytes uint64
+	start time.Time
+	bps   uint64
+}
+
+func (m *bitrateMeter) add(size int, now time.Time) {
+	if m.start.IsZero() {
+		m.start = now
+	}
+	m.bytes += uint64(size)
+	if elapsed := now.Sub(m.start); elapsed >= time.Second {
+		m.bps = m.bytes * 8 * uint64(time.Second) / uint64(elapsed)
+		m.bytes = 0
+		m.start = now
+	}
+}
+
+// rtpWriter receives the packets forwarded to a subscriber: the
+// TrackLocalStaticRTP of a peer or the trackRecorder of a recording.
+type rtpWriter interface {
+	WriteRTP(*rtp.Packet) error
+}
+
+// trackSubscriber keeps the forwarding state of one subscriber. Sequence
+// numbers and timestamps are rewritten so that switching layers looks like
+// a single continuous stream to the receiver (the SSRC is rewritten by the
+// TrackLocalStaticRTP binding).
+type trackSubscriber struct {
+	track     rtpWriter
+	preferred string // layer requested with set_layer, "" = best available
+	target    string // layer to switch to on the next keyframe
+	current   string // layer being forwarded
+	active    bool   // false until the first layer is selected
+	paused    bool   // stopped by bandwidth estimation
+	waitKey   bool   // resumed, wait for a keyframe before forwarding
+	maxLayer  int    // highest layer index allowed by bandwidth estimation, -1 = no cap
+
+	// VP9 SVC: highest spatial layer forwarded, -1 = all of them
+	spatial       int
+	targetSpatial int
+
+	lastSeq   uint16
+	lastTS    uint32
+	lastAt    time.Time
+	seqOffset uint16
+	tsOffset  uint32
+}
+
+func NewPublishedTrack(publisher *Peer, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver, media string) *PublishedTrack {
 	trackID := publisher.id + ":" + track.StreamID() + ":" + track.ID() + ":" + fmt.Sprintf("%d", track.SSRC())
 	streamID := publisher.id + ":" + track.StreamID()
 	return &PublishedTrack{
@@ -33,35 +100,145 @@ func NewPublishedTrack(publisher *Peer, track *webrtc.TrackRemote) *PublishedTra
 		publisher:   publisher,
 		trackID:     trackID,
 		streamID:    streamID,
+		kind:        track.Kind(),
+		media:       media,
 		codec:       track.Codec().RTPCodecCapability,
-		remote:      track,
-		subscribers: map[string]*webrtc.TrackLocalStaticRTP{},
+		layers:      []*trackLayer{{rid: track.RID(), remote: track}},
+		audioLevel:  audioLevelDetector{extensionID: audioLevelExtensionID(receiver)},
+		subscribers: map[string]*trackSubscriber{},
 		done:        make(chan struct{}),
 	}
 }
 
 func (p *PublishedTrack) Start() {
-	go func() {
-		for {
-			select {
-			case <-p.done:
-				return
-			default:
-			}
+	p.mu.Lock()
+	p.started = true
+	layers := append([]*trackLayer(nil), p.layers...)
+	p.mu.Unlock()
+
+	for _, layer := range layers {
+		go p.forward(layer)
+	}
+	if p.kind == webrtc.RTPCodecTypeAudio && p.audioLevel.extensionID != 0 {
+		go p.detectSpeech()
+	}
+}
+
+// AddLayer registers another simulcast encoding of the same track.
+func (p *PublishedTrack) AddLayer(track *webrtc.TrackRemote) {
+	layer := &trackLayer{rid: track.RID(), remote: track}
 
-			pkt, _, err := p.remote.ReadRTP()
-			if err != nil {
-				return
+	p.mu.Lock()
+	for _, existing := range p.layers {
+		if existing.rid == layer.rid {
+			p.mu.Unlock()
+			return
+		}
+	}
+	p.layers = append(p.layers, layer)
+	sortLayers(p.layers)
+	for _, sub := range p.subscribers {
+		sub.target = p.targetLayerLocked(sub)
+	}
+	started := p.started
+	p.mu.Unlock()
+
+	log.Printf("[TRACK %s] simulcast layer added rid=%s", p.key, layer.rid)
+	if started {
+		go p.forward(layer)
+	}
+	p.RequestKeyframe()
+}
+
+// Layers returns the RIDs of the available layers, lowest quality first.
+func (p *PublishedTrack) Layers() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	rids := make([]string, 0, len(p.layers))
+	for _, layer := range p.layers {
+		rids = append(rids, layer.rid)
+	}
+	return rids
+}
+
+func (p *PublishedTrack) isSimulcast() bool {
+	return len(p.layers) > 1 || p.layers[0].rid != ""
+}
+
+// forwardedPacket is a packet rewritten for one subscriber, written once
+// the track lock is released.
+type forwardedPacket struct {
+	track rtpWriter
+	pkt   *rtp.Packet
+}
+
+func (p *PublishedTrack) forward(layer *trackLayer) {
+	isVideo := p.kind == webrtc.RTPCodecTypeVideo
+	// The subscriber state is updated under the lock, the writes happen
+	// after it so that layers and subscribers do not wait on each other
+	var outgoing []forwardedPacket
+	for {
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+
+		pkt, _, err := layer.remote.ReadRTP()
+		if err != nil {
+			return
+		}
+		keyframe := isVideo && isKeyframe(p.codec.MimeType, pkt.Payload)
+		now := time.Now()
+
+		p.mu.Lock()
+		layer.bitrate.add(pkt.MarshalSize(), now)
+		if p.audioLevel.extensionID != 0 {
+			p.audioLevel.observe(pkt)
+		}
+		simulcast := p.isSimulcast()
+
+		svc := vp9Layer{sid: -1}
+		if isVideo && !simulcast && strings.EqualFold(p.codec.MimeType, webrtc.MimeTypeVP9) {
+			if parsed, ok := parseVP9Layer(pkt.Payload); ok && parsed.sid >= 0 {
+				svc = parsed
+				for len(p.spatial) <= svc.sid {
+					p.spatial = append(p.spatial, bitrateMeter{})
+				}
+				p.spatial[svc.sid].add(pkt.MarshalSize(), now)
 			}
+		}
 
-			p.mu.RLock()
-			for _, sub := range p.subscribers {
-				pktCopy := cloneRTP(pkt)
-				_ = sub.WriteRTP(pktCopy)
+		for _, sub := range p.subscribers {
+			if sub.paused {
+				continue
+			}
+			if sub.target == layer.rid && (!sub.active || sub.current != layer.rid || sub.waitKey) && (keyframe || (!simulcast && !sub.waitKey)) {
+				sub.switchTo(layer.rid, pkt, p.codec.ClockRate)
+				sub.waitKey = false
+			}
+			if !sub.active || sub.current != layer.rid || sub.waitKey {
+				continue
 			}
-			p.mu.RUnlock()
+			if svc.sid >= 0 && !sub.forwardsSpatial(svc, keyframe) {
+				sub.seqOffset++ // hide the dropped packet from the receiver
+				continue
+			}
+			out := sub.rewrite(pkt)
+			if svc.sid >= 0 && svc.sid == sub.spatial && svc.end {
+				out.Marker = true // last packet of the highest layer forwarded
+			}
+			outgoing = append(outgoing, forwardedPacket{track: sub.track, pkt: out})
 		}
-	}()
+		p.mu.Unlock()
+
+		for i, out := range outgoing {
+			_ = out.track.WriteRTP(out.pkt)
+			outgoing[i] = forwardedPacket{}
+		}
+		outgoing = outgoing[:0]
+	}
 }
 
 func (p *PublishedTrack) Stop() {
@@ -73,12 +250,24 @@ func (p *PublishedTrack) Stop() {
 	}
 }
 
-func (p *PublishedTrack) AddSubscriber(peerID string, track *webrtc.TrackLocalStaticRTP) {
+// AddSubscriber starts forwarding the track to peerID, or only registers it
+// when paused (e.g. a video hidden by last-N).
+func (p *PublishedTrack) AddSubscriber(peerID string, track rtpWriter, paused bool) {
 	p.mu.Lock()
-	p.subscribers[peerID] = track
+	sub := &trackSubscriber{
+		track:         track,
+		paused:        paused,
+		maxLayer:      -1,
+		spatial:       -1,
+		targetSpatial: -1,
+	}
+	sub.target = p.targetLayerLocked(sub)
+	p.subscribers[peerID] = sub
 	p.mu.Unlock()
 
-	p.RequestKeyframeBurst()
+	if !paused {
+		p.RequestKeyframeBurst()
+	}
 }
 
 func (p *PublishedTrack) RemoveSubscriber(peerID string) {
@@ -87,13 +276,132 @@ func (p *PublishedTrack) RemoveSubscriber(peerID string) {
 	p.mu.Unlock()
 }
 
+// SetSubscriberLayer selects the simulcast layer forwarded to peerID. An
+// empty or unknown rid selects the best layer available. The switch happens
+// on the next keyframe of the new layer.
+func (p *PublishedTrack) SetSubscriberLayer(peerID string, rid string) {
+	p.mu.Lock()
+	sub := p.subscribers[peerID]
+	if sub == nil {
+		p.mu.Unlock()
+		return
+	}
+	sub.preferred = rid
+	previous := sub.target
+	sub.target = p.targetLayerLocked(sub)
+	changed := sub.target != previous
+	p.mu.Unlock()
+
+	if changed {
+		p.RequestKeyframe()
+	}
+}
+
+// Qualities returns the bitrate (bps) needed to forward each quality level
+// of the track to peerID, lowest first: simulcast layers, VP9 spatial layers
+// (cumulative) or a single level. Levels above the one requested with
+// set_layer are left out. Rates are 0 until measured.
+func (p *PublishedTrack) Qualities(peerID string) []uint64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.isSimulcast() {
+		top := len(p.layers) - 1
+		if sub := p.subscribers[peerID]; sub != nil {
+			top = p.preferredIndexLocked(sub.preferred)
+		}
+		rates := make([]uint64, 0, top+1)
+		for _, layer := range p.layers[:top+1] {
+			rates = append(rates, layer.bitrate.bps)
+		}
+		return rates
+	}
+	if len(p.spatial) > 1 {
+		rates := make([]uint64, 0, len(p.spatial))
+		var total uint64
+		for _, meter := range p.spatial {
+			total += meter.bps
+			rates = append(rates, total)
+		}
+		return rates
+	}
+	return []uint64{p.layers[0].bitrate.bps}
+}
+
+// SetSubscriberQuality applies the quality level picked by bandwidth
+// estimation for peerID, an index into Qualities. A negative level pauses
+// the track; resuming waits for a keyframe.
+func (p *PublishedTrack) SetSubscriberQuality(peerID string, level int) {
+	p.mu.Lock()
+	sub := p.subscribers[peerID]
+	if sub == nil {
+		p.mu.Unlock()
+		return
+	}
+
+	needKeyframe := false
+	switch {
+	case level < 0:
+		sub.paused = true
+		sub.waitKey = false
+	case p.isSimulcast():
+		sub.maxLayer = level
+		previous := sub.target
+		sub.target = p.targetLayerLocked(sub)
+		needKeyframe = sub.target != previous
+	case len(p.spatial) > 1:
+		target := level
+		if level >= len(p.spatial)-1 {
+			target = -1
+		}
+		// Going up a spatial layer waits for a keyframe
+		needKeyframe = sub.targetSpatial >= 0 && (target < 0 || target > sub.targetSpatial)
+		sub.targetSpatial = target
+	}
+	if level >= 0 && sub.paused {
+		sub.paused = false
+		sub.waitKey = true
+		needKeyframe = true
+	}
+	p.mu.Unlock()
+
+	if needKeyframe {
+		p.RequestKeyframe()
+	}
+}
+
+// targetLayerLocked resolves the layer a subscriber should receive: the one
+// it asked for (or the best available), capped by bandwidth estimation.
+func (p *PublishedTrack) targetLayerLocked(sub *trackSubscriber) string {
+	index := p.preferredIndexLocked(sub.preferred)
+	if sub.maxLayer >= 0 && sub.maxLayer < index {
+		index = sub.maxLayer
+	}
+	return p.layers[index].rid
+}
+
+func (p *PublishedTrack) preferredIndexLocked(rid string) int {
+	for i, layer := range p.layers {
+		if layer.rid == rid {
+			return i
+		}
+	}
+	return len(p.layers) - 1
+}
+
 func (p *PublishedTrack) RequestKeyframe() {
-	if p.publisher == nil {
+	if p.publisher == nil || p.publisher.pubPC == nil {
 		return
 	}
-	_ = p.publisher.pubPC.WriteRTCP([]rtcp.Packet{
-		&rtcp.PictureLossIndication{MediaSSRC: uint32(p.remote.SSRC())},
-	})
+
+	p.mu.RLock()
+	packets := make([]rtcp.Packet, 0, len(p.layers))
+	for _, layer := range p.layers {
+		packets = append(packets, &rtcp.PictureLossIndication{MediaSSRC: uint32(layer.remote.SSRC())})
+	}
+	p.mu.RUnlock()
+
+	_ = p.publisher.pubPC.WriteRTCP(packets)
 }
 
 func (p *PublishedTrack) RequestKeyframeBurst() {
@@ -108,6 +416,80 @@ func (p *PublishedTrack) RequestKeyframeBurst() {
 	}()
 }
 
+// switchTo makes rid the forwarded layer starting with pkt, continuing the
+// outgoing sequence numbers and timestamps where the previous layer left off.
+func (s *trackSubscriber) switchTo(rid string, pkt *rtp.Packet, clockRate uint32) {
+	if s.active {
+		s.seqOffset = pkt.SequenceNumber - s.lastSeq - 1
+		delta := uint32(time.Since(s.lastAt).Seconds() * float64(clockRate))
+		if delta == 0 {
+			delta = 1
+		}
+		s.tsOffset = pkt.Timestamp - s.lastTS - delta
+	}
+	s.current = rid
+	s.active = true
+}
+
+// forwardsSpatial reports whether a VP9 packet of the given spatial layer is
+// forwarded. Lower targets apply at the next picture, higher ones wait for a
+// keyframe since upper layers depend on the lower ones.
+func (s *trackSubscriber) forwardsSpatial(layer vp9Layer, keyframe bool) bool {
+	if layer.sid == 0 && layer.start && s.targetSpatial != s.spatial {
+		down := s.targetSpatial >= 0 && (s.spatial < 0 || s.targetSpatial < s.spatial)
+		if down || keyframe {
+			s.spatial = s.targetSpatial
+		}
+	}
+	return s.spatial < 0 || layer.sid <= s.spatial
+}
+
+func (s *trackSubscriber) rewrite(pkt *rtp.Packet) *rtp.Packet {
+	out := cloneRTP(pkt)
+	out.SequenceNumber = pkt.SequenceNumber - s.seqOffset
+	out.Timestamp = pkt.Timestamp - s.tsOffset
+
+	// Only move forward, retransmitted or reordered packets keep their place
+	if s.lastAt.IsZero() || int16(out.SequenceNumber-s.lastSeq) > 0 {
+		s.lastSeq = out.SequenceNumber
+		s.lastTS = out.Timestamp
+		s.lastAt = time.Now()
+	}
+	return out
+}
+
+// sortLayers orders layers by the RIDs commonly used by browsers, from low
+// to high quality: q/h/f (quarter, half, full), l/m/h and 0/1/2. Unknown
+// RIDs sort after the known ones, in arrival order.
+func sortLayers(layers []*trackLayer) {
+	lowMidHigh := false
+	for _, layer := range layers {
+		if layer.rid == "l" || layer.rid == "m" {
+			lowMidHigh = true
+		}
+	}
+
+	rank := func(rid string) int {
+		switch rid {
+		case "q", "l", "low", "0":
+			return 0
+		case "m", "mid", "1":
+			return 1
+		case "h":
+			if lowMidHigh {
+				return 2
+			}
+			return 1
+		case "f", "high", "2":
+			return 2
+		}
+		return 3
+	}
+	sort.SliceStable(layers, func(i, j int) bool {
+		return rank(layers[i].rid) < rank(layers[j].rid)
+	})
+}
+
 func trackKey(peerID string, track *webrtc.TrackRemote) string {
 	return peerID + ":" + track.StreamID() + ":" + track.ID()
 }
@@ -0,0 +1,531 @@
+package sfu
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/h264writer"
+	"github.com/pion/webrtc/v3/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+)
+
+// Video containers accepted by RecordingConfig.VideoContainer.
+const (
+	ContainerWebM = "webm"
+	ContainerIVF  = "ivf"
+)
+
+const (
+	recorderSubscriberID = "recorder"
+	recorderQueue        = 512 // packets waiting to be written per track
+	recordJitterPackets  = 128 // reordering window before a gap is given up
+	recordManifestFile   = "manifest.json"
+)
+
+var (
+	ErrRecordingDisabled = errors.New("recording disabled")
+	ErrAlreadyRecording  = errors.New("already recording")
+)
+
+// RecordingConfig configures server-side recording of lessons.
+type RecordingConfig struct {
+	// Dir is where recordings are stored, one directory per recording.
+	// Empty disables recording.
+	Dir string `yaml:"dir" env:"RECORDING_DIR"`
+	// VideoContainer is webm (default) or ivf. IVF only holds VP8, VP9 is
+	// always written to WebM. H.264 goes to an Annex-B .h264 file and Opus
+	// to Ogg regardless.
+	VideoContainer string `yaml:"videoContainer" env:"RECORDING_VIDEO_CONTAINER"`
+	// Mix also writes the audio of all peers mixed into one file when the
+	// recording stops: ogg (Opus) or wav. Empty disables it. It needs
+	// ffmpeg, FFmpegPath defaults to the one in PATH.
+	Mix        string `yaml:"mix" env:"RECORDING_MIX"`
+	FFmpegPath string `yaml:"ffmpegPath" env:"RECORDING_FFMPEG"`
+}
+
+// Recorder writes every track published in a room to its own file, plus a
+// manifest tying the files to peers, users and wall-clock times. It is a
+// subscriber of each PublishedTrack, so it gets the same layer-switched
+// stream as a peer would (the best simulcast layer).
+type Recorder struct {
+	room *Room
+	cfg  RecordingConfig
+	dir  string
+
+	mu       sync.Mutex
+	manifest recordingManifest
+	tracks   map[string]*trackRecorder
+	stopped  bool
+}
+
+type recordingManifest struct {
+	RoomID    string           `json:"roomId"`
+	StartedBy string           `json:"startedBy"`
+	StartedAt time.Time        `json:"startedAt"`
+	StoppedAt *time.Time       `json:"stoppedAt,omitempty"`
+	Tracks    []*recordedTrack `json:"tracks"`
+	Mix       *recordedMix     `json:"mix,omitempty"`
+}
+
+type recordedTrack struct {
+	File      string     `json:"file"`
+	PeerID    string     `json:"peerId"`
+	UserID    string     `json:"userId"`
+	UserName  string     `json:"userName,omitempty"`
+	Kind      string     `json:"kind"` // audio, video or screen
+	Codec     string     `json:"codec"`
+	StartedAt *time.Time `json:"startedAt,omitempty"` // first packet written
+	EndedAt   *time.Time `json:"endedAt,omitempty"`
+	Packets   int        `json:"packets"`
+}
+
+// NewRecorder creates the directory of a new recording of room. Its name
+// is the room and the start time, with a -2, -3... suffix when another
+// recording started in the same second, so that it never reuses one.
+func NewRecorder(room *Room, cfg RecordingConfig, startedBy string) (*Recorder, error) {
+	now := time.Now()
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create recording dir: %w", err)
+	}
+	base := filepath.Join(cfg.Dir, safeFileName(room.id)+"-"+now.UTC().Format("20060102T150405Z"))
+	dir := base
+	for n := 2; ; n++ {
+		err := os.Mkdir(dir, 0o755)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrExist) || n > 100 {
+			return nil, fmt.Errorf("create recording dir: %w", err)
+		}
+		dir = fmt.Sprintf("%s-%d", base, n)
+	}
+
+	rec := &Recorder{
+		room: room,
+		cfg:  cfg,
+		dir:  dir,
+		manifest: recordingManifest{
+			RoomID:    room.id,
+			StartedBy: startedBy,
+			StartedAt: now,
+			Tracks:    []*recordedTrack{},
+		},
+		tracks: map[string]*trackRecorder{},
+	}
+	rec.mu.Lock()
+	rec.writeManifestLocked()
+	rec.mu.Unlock()
+	return rec, nil
+}
+
+// AddTrack starts recording pub until it stops or the recording ends.
+func (rec *Recorder) AddTrack(pub *PublishedTrack) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if existing := rec.tracks[pub.key]; rec.stopped || (existing != nil && existing.pub == pub) {
+		return
+	}
+
+	ext, container := recordingFormat(pub.codec.MimeType, rec.cfg.VideoContainer)
+	if ext == "" {
+		log.Printf("[ROOM %s] not recording %s: unsupported codec %s", rec.room.id, pub.key, pub.codec.MimeType)
+		return
+	}
+
+	var userID, userName string
+	if pub.publisher != nil {
+		userID, userName = pub.publisher.userID, pub.publisher.userName
+	}
+	name := fmt.Sprintf("%02d-%s-%s.%s", len(rec.manifest.Tracks)+1, safeFileName(userID), pub.media, ext)
+	writer, err := newMediaWriter(filepath.Join(rec.dir, name), pub.codec, container)
+	if err != nil {
+		log.Printf("[ROOM %s] recording %s failed: %v", rec.room.id, pub.key, err)
+		return
+	}
+
+	entry := &recordedTrack{
+		File:     name,
+		PeerID:   pub.publisherID,
+		UserID:   userID,
+		UserName: userName,
+		Kind:     pub.media,
+		Codec:    pub.codec.MimeType,
+	}
+	rec.manifest.Tracks = append(rec.manifest.Tracks, entry)
+	rec.writeManifestLocked()
+
+	track := &trackRecorder{
+		rec:          rec,
+		pub:          pub,
+		entry:        entry,
+		writer:       writer,
+		video:        pub.kind == webrtc.RTPCodecTypeVideo,
+		waitKeyframe: pub.kind == webrtc.RTPCodecTypeVideo,
+		jitter:       newJitterBuffer(recordJitterPackets),
+		packets:      make(chan *rtp.Packet, recorderQueue),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	rec.tracks[pub.key] = track
+	go track.run()
+
+	pub.AddSubscriber(recorderSubscriberID, track, false)
+	log.Printf("[ROOM %s] recording %s to %s", rec.room.id, pub.key, name)
+}
+
+// Stop ends the recording: every file is closed and the manifest written.
+func (rec *Recorder) Stop() {
+	rec.mu.Lock()
+	if rec.stopped {
+		rec.mu.Unlock()
+		return
+	}
+	rec.stopped = true
+	tracks := make([]*trackRecorder, 0, len(rec.tracks))
+	for _, track := range rec.tracks {
+		tracks = append(tracks, track)
+	}
+	rec.mu.Unlock()
+
+	for _, track := range tracks {
+		track.pub.RemoveSubscriber(recorderSubscriberID)
+		track.close()
+	}
+
+	rec.mu.Lock()
+	now := time.Now()
+	rec.manifest.StoppedAt = &now
+	rec.writeManifestLocked()
+	rec.mu.Unlock()
+	log.Printf("[ROOM %s] recording stopped: %s", rec.room.id, rec.dir)
+
+	if rec.cfg.Mix != "" {
+		go rec.mixAudio()
+	}
+}
+
+func (rec *Recorder) writeManifestLocked() {
+	data, err := json.MarshalIndent(rec.manifest, "", "  ")
+	if err != nil {
+		log.Printf("[ROOM %s] recording manifest: %v", rec.room.id, err)
+		return
+	}
+	// Write and rename so readers never see a half-written manifest
+	path := filepath.Join(rec.dir, recordManifestFile)
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		log.Printf("[ROOM %s] recording manifest: %v", rec.room.id, err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		log.Printf("[ROOM %s] recording manifest: %v", rec.room.id, err)
+	}
+}
+
+// trackRecorder writes one PublishedTrack. WriteRTP is called by the
+// forwarding loop and only queues the packet; run does the disk work.
+type trackRecorder struct {
+	rec          *Recorder
+	pub          *PublishedTrack
+	entry        *recordedTrack
+	writer       media.Writer
+	video        bool
+	waitKeyframe bool
+	jitter       *jitterBuffer
+
+	packets   chan *rtp.Packet
+	stop      chan struct{}
+	stopOnce  sync.Once
+	done      chan struct{}
+	dropped   atomic.Int64
+	lastError error
+}
+
+func (t *trackRecorder) WriteRTP(pkt *rtp.Packet) error {
+	select {
+	case t.packets <- pkt:
+	default:
+		t.dropped.Add(1) // disk too slow, better a gap than stalling the room
+	}
+	return nil
+}
+
+func (t *trackRecorder) run() {
+	defer close(t.done)
+	for {
+		select {
+		case pkt := <-t.packets:
+			ready, lost := t.jitter.push(pkt)
+			if lost && t.video {
+				t.waitKeyframe = true
+				t.pub.RequestKeyframe()
+			}
+			t.write(ready)
+		case <-t.pub.done:
+			t.finish()
+			return
+		case <-t.stop:
+			t.finish()
+			return
+		}
+	}
+}
+
+func (t *trackRecorder) write(packets []*rtp.Packet) {
+	for _, pkt := range packets {
+		if t.waitKeyframe {
+			if !isKeyframe(t.pub.codec.MimeType, pkt.Payload) {
+				continue
+			}
+			t.waitKeyframe = false
+		}
+		if err := t.writer.WriteRTP(pkt); err != nil && t.lastError == nil {
+			t.lastError = err
+			log.Printf("[ROOM %s] recording %s: %v", t.rec.room.id, t.entry.File, err)
+		}
+
+		t.rec.mu.Lock()
+		if t.entry.StartedAt == nil {
+			now := time.Now()
+			t.entry.StartedAt = &now
+			t.rec.writeManifestLocked()
+		}
+		t.entry.Packets++
+		t.rec.mu.Unlock()
+	}
+}
+
+// finish flushes the reordering buffer and closes the file.
+func (t *trackRecorder) finish() {
+	t.write(t.jitter.flush())
+	if err := t.writer.Close(); err != nil {
+		log.Printf("[ROOM %s] recording %s: close: %v", t.rec.room.id, t.entry.File, err)
+	}
+	if dropped := t.dropped.Load(); dropped > 0 {
+		log.Printf("[ROOM %s] recording %s: %d packets dropped", t.rec.room.id, t.entry.File, dropped)
+	}
+
+	t.rec.mu.Lock()
+	now := time.Now()
+	t.entry.EndedAt = &now
+	t.rec.writeManifestLocked()
+	t.rec.mu.Unlock()
+}
+
+func (t *trackRecorder) close() {
+	t.stopOnce.Do(func() { close(t.stop) })
+	<-t.done
+}
+
+// recordingFormat returns the file extension and container for a codec, or
+// "" if it cannot be recorded.
+func recordingFormat(mimeType string, videoContainer string) (string, string) {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		return "ogg", "ogg"
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return "h264", "h264"
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		if videoContainer == ContainerIVF {
+			return "ivf", ContainerIVF
+		}
+		return "webm", ContainerWebM
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return "webm", ContainerWebM
+	}
+	return "", ""
+}
+
+func newMediaWriter(path string, codec webrtc.RTPCodecCapability, container string) (media.Writer, error) {
+	switch container {
+	case "ogg":
+		channels := codec.Channels
+		if channels == 0 {
+			channels = 2
+		}
+		return oggwriter.New(path, codec.ClockRate, channels)
+	case "h264":
+		return h264writer.New(path)
+	case ContainerIVF:
+		return ivfwriter.New(path)
+	case ContainerWebM:
+		return newWebMWriter(path, codec.MimeType)
+	}
+	return nil, fmt.Errorf("unknown container %q", container)
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+func safeFileName(name string) string {
+	name = unsafeFileChars.ReplaceAllString(name, "_")
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+// jitterBuffer puts RTP packets back in sequence order. A missing packet
+// is waited for until capacity packets are buffered behind it.
+type jitterBuffer struct {
+	packets  map[uint16]*rtp.Packet
+	next     uint16
+	started  bool
+	capacity int
+}
+
+func newJitterBuffer(capacity int) *jitterBuffer {
+	return &jitterBuffer{packets: map[uint16]*rtp.Packet{}, capacity: capacity}
+}
+
+// push adds pkt and returns the packets that are now in order. lost reports
+// that a gap was skipped.
+func (j *jitterBuffer) push(pkt *rtp.Packet) (ready []*rtp.Packet, lost bool) {
+	if !j.started {
+		j.next = pkt.SequenceNumber
+		j.started = true
+	}
+	if int16(pkt.SequenceNumber-j.next) < 0 {
+		return nil, false // late or duplicate
+	}
+	j.packets[pkt.SequenceNumber] = pkt
+
+	for len(j.packets) > 0 {
+		if next, ok := j.packets[j.next]; ok {
+			ready = append(ready, next)
+			delete(j.packets, j.next)
+			j.next++
+			continue
+		}
+		if len(j.packets) < j.capacity {
+			break
+		}
+		j.next = j.oldest()
+		lost = true
+	}
+	return ready, lost
+}
+
+// flush returns everything still buffered, in order.
+func (j *jitterBuffer) flush() []*rtp.Packet {
+	var out []*rtp.Packet
+	for len(j.packets) > 0 {
+		j.next = j.oldest()
+		out = append(out, j.packets[j.next])
+		delete(j.packets, j.next)
+		j.next++
+	}
+	return out
+}
+
+func (j *jitterBuffer) oldest() uint16 {
+	first := true
+	var oldest uint16
+	for seq := range j.packets {
+		if first || int16(seq-oldest) < 0 {
+			oldest = seq
+			first = false
+		}
+	}
+	return oldest
+}
+
+// recordingSlot is the key of Room.reserved while a recording starts.
+const recordingSlot = "recording"
+
+// StartRecording starts recording every track of the room.
+func (r *Room) StartRecording(by *Peer) error {
+	if r.cfg.Recording.Dir == "" {
+		return ErrRecordingDisabled
+	}
+
+	// The recording is reserved while its directory and manifest are
+	// written, outside the room lock so that a slow disk does not hold up
+	// joins and publishes
+	r.mu.Lock()
+	if r.recorder != nil || r.reserved[recordingSlot] {
+		r.mu.Unlock()
+		return ErrAlreadyRecording
+	}
+	r.reserved[recordingSlot] = true
+	r.mu.Unlock()
+
+	rec, err := NewRecorder(r, r.cfg.Recording, by.userID)
+
+	r.mu.Lock()
+	delete(r.reserved, recordingSlot)
+	if err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	r.recorder = rec
+	published := make([]*PublishedTrack, 0, len(r.published))
+	for _, pub := range r.published {
+		published = append(published, pub)
+	}
+	r.mu.Unlock()
+
+	for _, pub := range published {
+		rec.AddTrack(pub)
+	}
+	log.Printf("[ROOM %s] recording started by %s in %s", r.id, by.id[:8], rec.dir)
+	r.BroadcastToAll(Signal{Type: "recording_started", PeerID: by.id, UserID: by.userID})
+	return nil
+}
+
+// StopRecording ends the current recording, if any.
+func (r *Room) StopRecording() bool {
+	r.mu.Lock()
+	rec := r.recorder
+	r.recorder = nil
+	r.mu.Unlock()
+
+	if rec == nil {
+		return false
+	}
+	rec.Stop()
+	r.BroadcastToAll(Signal{Type: "recording_stopped"})
+	return true
+}
+
+func (r *Room) IsRecording() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.recorder != nil
+}
+
+// handleRecording implements the host-only `start_recording` and
+// `stop_recording` commands.
+func (p *Peer) handleRecording(msg Signal) {
+	if !p.isHost() {
+		p.sendError("not allowed: host only")
+		return
+	}
+
+	if msg.Type == "stop_recording" {
+		if !p.room.StopRecording() {
+			p.sendError("not recording")
+		}
+		return
+	}
+	if err := p.room.StartRecording(p); err != nil {
+		log.Printf("[PEER %s] start_recording: %v", p.id[:8], err)
+		switch {
+		case errors.Is(err, ErrRecordingDisabled), errors.Is(err, ErrAlreadyRecording):
+			p.sendError(err.Error())
+		default:
+			p.sendError("recording failed")
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package sfu
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Composite audio. When RecordingConfig.Mix is set, the Opus files of a
+// recording are mixed into a single file once it stops. Decoding and mixing
+// is left to ffmpeg, a runtime dependency of this option checked by
+// Config.Validate: each track is delayed by the time between the start of
+// the recording and its first packet (late joiners), and the gaps inside a
+// track (mute, DTX, lost packets) are filled with silence from the Ogg
+// granule positions, which follow the RTP timestamps.
+const (
+	MixOgg = "ogg"
+	MixWAV = "wav"
+
+	recordMixFile    = "mix"
+	recordMixTimeout = time.Hour
+)
+
+type recordedMix struct {
+	File   string `json:"file"`
+	Status string `json:"status"` // mixing, done or failed
+	Error  string `json:"error,omitempty"`
+}
+
+// mixAudio builds the composite audio file of a stopped recording.
+func (rec *Recorder) mixAudio() {
+	rec.mu.Lock()
+	start := rec.manifest.StartedAt
+	var inputs []string
+	var delays []time.Duration
+	for _, track := range rec.manifest.Tracks {
+		if track.Kind != mediaAudio || track.StartedAt == nil || !strings.EqualFold(track.Codec, webrtc.MimeTypeOpus) {
+			continue
+		}
+		inputs = append(inputs, filepath.Join(rec.dir, track.File))
+		delays = append(delays, track.StartedAt.Sub(start))
+	}
+	if len(inputs) == 0 {
+		rec.mu.Unlock()
+		return
+	}
+	mix := &recordedMix{File: recordMixFile + "." + rec.cfg.Mix, Status: "mixing"}
+	rec.manifest.Mix = mix
+	rec.writeManifestLocked()
+	rec.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), recordMixTimeout)
+	defer cancel()
+	args := mixArgs(inputs, delays, filepath.Join(rec.dir, mix.File), rec.cfg.Mix)
+	output, err := exec.CommandContext(ctx, rec.ffmpegPath(), args...).CombinedOutput()
+
+	rec.mu.Lock()
+	if err != nil {
+		mix.Status = "failed"
+		mix.Error = err.Error()
+		log.Printf("[ROOM %s] audio mix failed: %v\n%s", rec.room.id, err, lastLines(string(output), 5))
+	} else {
+		mix.Status = "done"
+		log.Printf("[ROOM %s] audio mix of %d tracks: %s", rec.room.id, len(inputs), mix.File)
+	}
+	rec.writeManifestLocked()
+	rec.mu.Unlock()
+}
+
+func (rec *Recorder) ffmpegPath() string {
+	return ffmpegPath(rec.cfg.FFmpegPath)
+}
+
+// ffmpegPath returns the ffmpeg to run for a configured path, the one in
+// PATH by default.
+func ffmpegPath(configured string) string {
+	if configured != "" {
+		return configured
+	}
+	return "ffmpeg"
+}
+
+// mixArgs returns the ffmpeg arguments mixing inputs, each starting after
+// its delay, into output.
+func mixArgs(inputs []string, delays []time.Duration, output string, format string) []string {
+	args := []string{"-hide_banner", "-loglevel", "error", "-y"}
+	for _, input := range inputs {
+		args = append(args, "-i", input)
+	}
+
+	var filter strings.Builder
+	for i, delay := range delays {
+		if delay < 0 {
+			delay = 0
+		}
+		fmt.Fprintf(&filter, "[%d:a]aresample=async=1:first_pts=0,adelay=%d:all=1[a%d];", i, delay.Milliseconds(), i)
+	}
+	for i := range inputs {
+		fmt.Fprintf(&filter, "[a%d]", i)
+	}
+	// normalize=0: a voice must not get quieter because more peers joined
+	fmt.Fprintf(&filter, "amix=inputs=%d:duration=longest:dropout_transition=0:normalize=0[out]", len(inputs))
+	args = append(args, "-filter_complex", filter.String(), "-map", "[out]", "-ar", "48000", "-ac", "1")
+
+	if format == MixWAV {
+		args = append(args, "-c:a", "pcm_s16le")
+	} else {
+		args = append(args, "-c:a", "libopus", "-b:a", "64k")
+	}
+	return append(args, output)
+}
+
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,62 @@
+package sfu
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMixArgs(t *testing.T) {
+	inputs := []string{"rec/01-7-audio.ogg", "rec/02-42-audio.ogg", "rec/03-43-audio.ogg"}
+	// The first track started with the recording, the second 2.5s later
+	// (late joiner), the third was stamped slightly before the start
+	delays := []time.Duration{0, 2500 * time.Millisecond, -20 * time.Millisecond}
+
+	args := mixArgs(inputs, delays, "rec/mix.ogg", MixOgg)
+
+	var gotInputs []string
+	var filter string
+	for i := 0; i < len(args)-1; i++ {
+		switch args[i] {
+		case "-i":
+			gotInputs = append(gotInputs, args[i+1])
+		case "-filter_complex":
+			filter = args[i+1]
+		}
+	}
+	if !reflect.DeepEqual(gotInputs, inputs) {
+		t.Fatalf("inputs %v, want %v", gotInputs, inputs)
+	}
+
+	chains := strings.Split(filter, ";")
+	if len(chains) != len(inputs)+1 {
+		t.Fatalf("filter %q: want one chain per input and the mix", filter)
+	}
+	for i, want := range []string{
+		// Gaps inside a track are filled from its timestamps, then the
+		// track is delayed to where it started in the recording
+		"[0:a]aresample=async=1:first_pts=0,adelay=0:all=1[a0]",
+		"[1:a]aresample=async=1:first_pts=0,adelay=2500:all=1[a1]",
+		"[2:a]aresample=async=1:first_pts=0,adelay=0:all=1[a2]",
+	} {
+		if chains[i] != want {
+			t.Errorf("chain %d = %q, want %q", i, chains[i], want)
+		}
+	}
+	if want := "[a0][a1][a2]amix=inputs=3:duration=longest:dropout_transition=0:normalize=0[out]"; chains[3] != want {
+		t.Errorf("mix = %q, want %q", chains[3], want)
+	}
+
+	if !strings.Contains(strings.Join(args, " "), "-map [out] -ar 48000 -ac 1 -c:a libopus") {
+		t.Errorf("ogg output args: %v", args)
+	}
+	if args[len(args)-1] != "rec/mix.ogg" {
+		t.Errorf("output %q, want rec/mix.ogg", args[len(args)-1])
+	}
+
+	wav := mixArgs(inputs[:1], delays[:1], "rec/mix.wav", MixWAV)
+	if !strings.Contains(strings.Join(wav, " "), "-c:a pcm_s16le rec/mix.wav") {
+		t.Errorf("wav output args: %v", wav)
+	}
+}
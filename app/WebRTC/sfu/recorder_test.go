@@ -0,0 +1,41 @@
+package sfu
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestRecordingNeverReusesDir(t *testing.T) {
+	cfg := DefaultConfig().Rooms
+	cfg.Recording.Dir = t.TempDir()
+	room := NewRoom("lesson-1", cfg, func(*Room) {}, func(*Room) {})
+	host := &Peer{id: "host-peer-0001", userID: "7", role: RoleHost}
+
+	// Stop and start again within the same second
+	dirs := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		if err := room.StartRecording(host); err != nil {
+			t.Fatal(err)
+		}
+		if err := room.StartRecording(host); !errors.Is(err, ErrAlreadyRecording) {
+			t.Fatalf("second start: err = %v, want %v", err, ErrAlreadyRecording)
+		}
+		room.mu.RLock()
+		dir := room.recorder.dir
+		room.mu.RUnlock()
+		if dirs[dir] {
+			t.Fatalf("recording %d reuses %s", i+1, dir)
+		}
+		dirs[dir] = true
+		room.StopRecording()
+	}
+
+	entries, err := os.ReadDir(cfg.Recording.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("%d recording dirs, want 3", len(entries))
+	}
+}
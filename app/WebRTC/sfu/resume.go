@@ -0,0 +1,224 @@
+package sfu
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+// Session resumption. `joined` carries a resume token. When the WebSocket
+// of a joined peer drops, the Peer is detached instead of removed: its
+// PeerConnections, published tracks and subscriptions stay, signals to it
+// are dropped and nobody sees peer_left. A client that reconnects within
+// RoomConfig.ResumeGrace and sends as first message
+//
+//	{"type": "resume", "sessionId": ..., "peerId": ..., "resumeToken": ...}
+//
+// takes its peer back: it gets `resumed` with a new token and a fresh room
+// snapshot, the server restarts ICE on the sub PeerConnection and the
+// client restarts it on the pub one. A resume also takes over a connection
+// the server still believes alive, e.g. half-open after a Wi-Fi drop.
+
+var (
+	errResumeFailed = errors.New("resume failed")
+	errPeerDetached = errors.New("peer detached")
+)
+
+// resume handles a `resume` sent as first message on conn.
+func (s *Server) resume(conn *websocket.Conn, msg Signal) {
+	room := s.lookupRoom(msg.SessionID)
+	if room == nil {
+		_ = sendJSON(conn, Signal{Type: "error", Message: errResumeFailed.Error()})
+		return
+	}
+	defer room.Release()
+
+	peer := room.GetPeer(msg.PeerID)
+	if peer == nil {
+		_ = sendJSON(conn, Signal{Type: "error", Message: errResumeFailed.Error()})
+		return
+	}
+	gen, err := peer.attach(conn, msg.ResumeToken)
+	if err != nil {
+		log.Printf("[PEER %s] resume rejected: %v", peer.id[:8], err)
+		_ = sendJSON(conn, Signal{Type: "error", Message: errResumeFailed.Error()})
+		return
+	}
+
+	log.Printf("peer resumed user=%s session=%s peer=%s", peer.userID, room.id, peer.id)
+	room.Resume(peer)
+	s.serve(room, peer, conn, gen)
+}
+
+// serve runs the signaling of peer on conn, connection gen. When it ends the
+// peer waits detached for a resume; it is removed if none comes within
+// ResumeGrace, unless another connection took it over.
+func (s *Server) serve(room *Room, peer *Peer, conn *websocket.Conn, gen int) {
+	peer.ReadLoop(conn)
+
+	peer.stateMu.RLock()
+	waiting := peer.waiting
+	peer.stateMu.RUnlock()
+	if grace := room.cfg.ResumeGrace; grace > 0 && !waiting {
+		resumed, ok := peer.detach(gen)
+		if !ok {
+			return
+		}
+		log.Printf("[PEER %s] connection lost, waiting %s for a resume", peer.id[:8], grace)
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case <-resumed:
+			return
+		case <-timer.C:
+		case <-peer.Done():
+		}
+	}
+
+	if !peer.expire(gen) {
+		return
+	}
+	room.LeaveLobby(peer.id)
+	room.RemovePeer(peer.id)
+	peer.Close()
+	log.Printf("peer disconnected user=%s session=%s peer=%s", peer.userID, room.id, peer.id)
+}
+
+// lookupRoom returns an existing room with a reference taken on it.
+func (s *Server) lookupRoom(id string) *Room {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if room := s.rooms[id]; room != nil && room.acquire() {
+		return room
+	}
+	return nil
+}
+
+// Resume sends a resumed peer what it may have missed while detached. Its
+// ICE is restarted with the next sub_offer, sent on sub_ready.
+func (r *Room) Resume(peer *Peer) {
+	_ = peer.Send(Signal{
+		Type:         "resumed",
+		PeerID:       peer.id,
+		Role:         string(peer.role),
+		ResumeToken:  peer.currentResumeToken(),
+		AudioAllowed: peer.canPublish(mediaAudio),
+		VideoAllowed: peer.canPublish(mediaVideo),
+		ICEServers:   r.cfg.ICE.serversFor(peer.userID, time.Now()),
+	})
+	_ = peer.Send(Signal{Type: "peer_list", Users: r.SnapshotUsers(peer.id), Hands: r.HandQueue()})
+	r.sendRoomState(peer)
+	if peer.isHost() {
+		r.sendLobbyUpdate()
+	}
+	peer.restartICE()
+}
+
+func (p *Peer) currentResumeToken() string {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	return p.resumeToken
+}
+
+// resumable reports whether the peer survives losing its connection.
+func (p *Peer) resumable() bool {
+	return p.subPC != nil && p.room.cfg.ResumeGrace > 0
+}
+
+// attach makes conn the signaling connection of the peer if token is its
+// resume token, closing the previous one. It returns the new connection
+// generation.
+func (p *Peer) attach(conn *websocket.Conn, token string) (int, error) {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+
+	if p.expired || p.resumeToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(p.resumeToken)) != 1 {
+		return 0, errResumeFailed
+	}
+	select {
+	case <-p.closed:
+		return 0, errResumeFailed
+	default:
+	}
+
+	if p.detached {
+		close(p.resumed)
+		p.resumed = nil
+	} else {
+		// Take over a connection that has not noticed it is dead
+		close(p.connDone)
+		_ = p.ws.Close()
+	}
+	p.ws = conn
+	p.connGen++
+	p.connDone = make(chan struct{})
+	p.detached = false
+	p.resumeToken = randomHex(16)
+	// Signals queued for the old connection are stale
+	for drained := false; !drained; {
+		select {
+		case <-p.send:
+		default:
+			drained = true
+		}
+	}
+	go p.writeLoop(conn, p.connDone)
+	return p.connGen, nil
+}
+
+// detach marks the peer as disconnected after connection gen ended. It
+// returns a channel closed on resume, or false if another connection
+// already took over.
+func (p *Peer) detach(gen int) (<-chan struct{}, bool) {
+	p.connMu.Lock()
+	if gen != p.connGen || p.expired {
+		p.connMu.Unlock()
+		return nil, false
+	}
+	p.detached = true
+	close(p.connDone)
+	p.resumed = make(chan struct{})
+	resumed := p.resumed
+	p.connMu.Unlock()
+
+	// sub_offers wait for the sub_ready of the resumed client
+	p.subNegotiationMu.Lock()
+	p.subReady = false
+	p.subNegotiationMu.Unlock()
+	return resumed, true
+}
+
+// expire ends connection gen for good. It returns false if another
+// connection took over, in which case the peer must be left alone.
+func (p *Peer) expire(gen int) bool {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+
+	if gen != p.connGen || p.expired {
+		return false
+	}
+	p.expired = true
+	return true
+}
+
+// restartICE renegotiates the sub PeerConnection with new ICE credentials
+// once the client is ready. An offer lost with the old connection is sent
+// again first.
+func (p *Peer) restartICE() {
+	p.subNegotiationMu.Lock()
+	p.restartSubICE = true
+	p.pendingSubNegotiation = true
+	var lost *webrtc.SessionDescription
+	if p.subPC.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		lost = p.subPC.LocalDescription()
+	}
+	p.subNegotiationMu.Unlock()
+
+	if lost != nil {
+		_ = p.Send(Signal{Type: "sub_offer", SDP: lost.SDP})
+	}
+}
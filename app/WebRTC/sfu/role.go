@@ -0,0 +1,151 @@
+package sfu
+
+import (
+	"log"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Role defines what a participant is allowed to do in a room.
+type Role string
+
+const (
+	RoleHost     Role = "host"     // professor or administrator: full control
+	RoleStudent  Role = "student"  // audio (and video once allowed), no screen share
+	RoleObserver Role = "observer" // subscribe-only, has no pub PeerConnection
+)
+
+// Media kinds checked by Peer.canPublish.
+const (
+	mediaAudio  = "audio"
+	mediaVideo  = "video"
+	mediaScreen = "screen"
+)
+
+// ParseRole maps a role coming from a token or an authorizer to a Role.
+// Laravel user roles are accepted as aliases; unknown values yield "".
+func ParseRole(value string) Role {
+	switch value {
+	case "host", "professor", "administrator":
+		return RoleHost
+	case "student":
+		return RoleStudent
+	case "observer":
+		return RoleObserver
+	}
+	return ""
+}
+
+// canPublish reports whether the peer may publish the given media kind.
+func (p *Peer) canPublish(kind string) bool {
+	p.stateMu.RLock()
+	defer p.stateMu.RUnlock()
+
+	switch p.role {
+	case RoleHost:
+		return true
+	case RoleStudent:
+		switch kind {
+		case mediaAudio:
+			return p.audioAllowed || p.audioGranted
+		case mediaVideo:
+			return p.videoAllowed
+		}
+	}
+	return false
+}
+
+// publishKind classifies an incoming track as audio, camera video or screen
+// share (a video track on the stream announced with `screen_stream`).
+func (p *Peer) publishKind(track *webrtc.TrackRemote) string {
+	if track.Kind() == webrtc.RTPCodecTypeAudio {
+		return mediaAudio
+	}
+
+	p.stateMu.RLock()
+	defer p.stateMu.RUnlock()
+	if p.screenStreamID != "" && track.StreamID() == p.screenStreamID {
+		return mediaScreen
+	}
+	return mediaVideo
+}
+
+// refuseTrack tells the peer why its track is refused and stops receiving
+// it. The transceiver goes inactive, so the answer to the next pub_offer
+// also stops the client from sending it on its uplink.
+func (p *Peer) refuseTrack(receiver *webrtc.RTPReceiver, reason string) {
+	p.sendError(reason)
+	if p.pubPC != nil {
+		for _, transceiver := range p.pubPC.GetTransceivers() {
+			if transceiver.Receiver() == receiver {
+				_ = transceiver.Stop()
+				return
+			}
+		}
+	}
+	_ = receiver.Stop()
+}
+
+// hasOtherVideoLocked reports whether peerID already publishes a video
+// track other than key. Non-hosts get a single one, their camera: a screen
+// share they do not announce with `screen_stream` would otherwise come in
+// as a second camera. Caller holds r.mu.
+func (r *Room) hasOtherVideoLocked(peerID, key string) bool {
+	for _, pub := range r.published {
+		if pub.publisherID == peerID && pub.kind == webrtc.RTPCodecTypeVideo && pub.key != key {
+			return true
+		}
+	}
+	return false
+}
+
+// isHost reports whether the peer may run host-only commands.
+func (p *Peer) isHost() bool {
+	return p.role == RoleHost
+}
+
+// handleSetVideoAllowed implements the host `promote`/`demote` commands that
+// let a student publish video or take that permission back.
+func (p *Peer) handleSetVideoAllowed(msg Signal, allowed bool) {
+	if !p.isHost() {
+		p.sendError("not allowed: host only")
+		return
+	}
+
+	target := p.room.GetPeer(msg.PeerID)
+	if target == nil {
+		p.sendError("unknown peer")
+		return
+	}
+	if target.role != RoleStudent {
+		p.sendError("target is not a student")
+		return
+	}
+
+	target.stateMu.Lock()
+	target.videoAllowed = allowed
+	if !allowed {
+		target.videoEnabled = false
+		target.screenEnabled = false
+	}
+	target.stateMu.Unlock()
+
+	log.Printf("[PEER %s] %s videoAllowed=%v", p.id[:8], target.id[:8], allowed)
+	if !allowed {
+		p.room.RemovePublishedTracksByKind(target.id, mediaVideo)
+		target.broadcastMediaState()
+	}
+	target.broadcastPermissions()
+}
+
+// broadcastPermissions tells the room what the peer may publish now.
+func (p *Peer) broadcastPermissions() {
+	p.room.BroadcastToAll(Signal{
+		Type:         "permissions",
+		PeerID:       p.id,
+		UserID:       p.userID,
+		Role:         string(p.role),
+		AudioAllowed: p.canPublish(mediaAudio),
+		VideoAllowed: p.canPublish(mediaVideo),
+	})
+}
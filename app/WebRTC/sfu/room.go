@@ -1,7 +1,9 @@
 package sfu
 
 import (
+	"log"
 	"sync"
+	"time"
 
 	"github.com/pion/webrtc/v3"
 )
@@ -9,22 +11,70 @@ import (
 type Room struct {
 	id        string
 	peers     map[string]*Peer
+	lobby     map[string]*Peer // waiting for a host to admit them
 	published map[string]*PublishedTrack
+	banned    map[string]bool // userIDs banned by a host, checked on (re)join
+	recorder  *Recorder       // nil unless a host started recording
+	egress    map[string]*Egress
+	reserved  map[string]bool // egress destinations and the recording being started, see StartEgress
+	viewers   map[string]*whepViewer // WHEP, not counted as peers
+	chat      *chatLog
 	mu        sync.RWMutex
+
+	// Lifecycle, see room_lifecycle.go
+	cfg            RoomConfig
+	onEmpty        func(*Room) // empty timeout fired
+	onExpire       func(*Room) // deadline reached
+	lifeMu         sync.Mutex  // Protege: refs, closed, timers, deadline
+	refs           int
+	closed         bool
+	emptyTimer     *time.Timer
+	deadline       time.Time
+	deadlineTimers []*time.Timer
+
+	// Active speakers, see last_n.go
+	speakerMu  sync.Mutex // Protege: speakers, levels, dominant, dominantAt
+	speakers   []string   // peer IDs, most recent speaker first
+	levels     map[string]float64 // voice activity of the peers speaking, see audio_level.go
+	dominant   string
+	dominantAt time.Time
+
+	// Hand-raise queue, see hand_queue.go
+	handMu sync.Mutex // Protege: hands
+	hands  []HandRaise
 }
 
-func NewRoom(id string) *Room {
-	return &Room{
+func NewRoom(id string, cfg RoomConfig, onEmpty, onExpire func(*Room)) *Room {
+	r := &Room{
 		id:        id,
 		peers:     map[string]*Peer{},
+		lobby:     map[string]*Peer{},
 		published: map[string]*PublishedTrack{},
+		banned:    map[string]bool{},
+		levels:    map[string]float64{},
+		egress:    map[string]*Egress{},
+		reserved:  map[string]bool{},
+		viewers:   map[string]*whepViewer{},
+		chat:      newChatLog(id, cfg.Chat),
+		cfg:       cfg,
+		onEmpty:   onEmpty,
+		onExpire:  onExpire,
+	}
+	if cfg.MaxDuration > 0 {
+		r.scheduleDeadlineLocked(time.Now().Add(cfg.MaxDuration))
 	}
+	return r
 }
 
-func (r *Room) AddPeer(peer *Peer) {
+func (r *Room) AddPeer(peer *Peer) error {
 	r.mu.Lock()
+	if r.isFullLocked(peer.role) {
+		r.mu.Unlock()
+		return ErrRoomFull
+	}
 	r.peers[peer.id] = peer
 	r.mu.Unlock()
+	r.addSpeaker(peer.id)
 
 	added := 0
 	r.mu.RLock()
@@ -39,6 +89,47 @@ func (r *Room) AddPeer(peer *Peer) {
 	if added > 0 {
 		peer.negotiateSub()
 	}
+	return nil
+}
+
+func (r *Room) GetPeer(peerID string) *Peer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.peers[peerID]
+}
+
+// Ban adds userID to the ban list and returns the peers it currently has in
+// the room, or waiting in the lobby, so the caller can disconnect them. The
+// lobby ones are taken out of the lobby.
+func (r *Room) Ban(userID string) []*Peer {
+	r.mu.Lock()
+	r.banned[userID] = true
+	var peers []*Peer
+	for _, peer := range r.peers {
+		if peer.userID == userID {
+			peers = append(peers, peer)
+		}
+	}
+	waiting := false
+	for id, peer := range r.lobby {
+		if peer.userID == userID {
+			peers = append(peers, peer)
+			delete(r.lobby, id)
+			waiting = true
+		}
+	}
+	r.mu.Unlock()
+
+	if waiting {
+		r.sendLobbyUpdate()
+	}
+	return peers
+}
+
+func (r *Room) IsBanned(userID string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.banned[userID]
 }
 
 func (r *Room) SnapshotUsers(excludePeerID string) []UserInfo {
@@ -80,6 +171,7 @@ func (r *Room) RemovePeer(peerID string) {
 	r.mu.Lock()
 	peer := r.peers[peerID]
 	delete(r.peers, peerID)
+	r.removeSpeaker(peerID)
 
 	var removed []*PublishedTrack
 	for key, pub := range r.published {
@@ -108,26 +200,73 @@ func (r *Room) RemovePeer(peerID string) {
 	for _, other := range remaining {
 		_ = other.Send(Signal{Type: "peer_left", PeerID: peerID})
 	}
+	if _, removed := r.lowerHand(peerID); removed {
+		r.broadcastHands()
+	}
 
 	r.mu.RLock()
 	for _, pub := range r.published {
 		pub.RemoveSubscriber(peerID)
 	}
 	r.mu.RUnlock()
+
+	// The next speaker in line may become visible under last-N
+	if r.cfg.LastN > 0 {
+		r.refreshForwarding()
+	}
 }
 
-func (r *Room) AddPublishedTrack(peer *Peer, track *webrtc.TrackRemote) {
-	pub := NewPublishedTrack(peer, track)
+func (r *Room) AddPublishedTrack(peer *Peer, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	kind := peer.publishKind(track)
+	if !peer.canPublish(kind) {
+		log.Printf("[ROOM %s] refusing %s track from peer %s (role=%s)", r.id, kind, peer.id[:8], peer.role)
+		peer.refuseTrack(receiver, "not allowed to publish "+kind)
+		return
+	}
 
 	r.mu.Lock()
+	// Simulcast: every RID of a track fires OnTrack, group them as layers
+	if existing := r.published[trackKey(peer.id, track)]; existing != nil && track.RID() != "" {
+		r.mu.Unlock()
+		existing.AddLayer(track)
+		r.BroadcastToAll(Signal{Type: "layers", PeerID: peer.id, StreamID: existing.streamID, TrackKind: existing.kind.String(), Layers: existing.Layers()})
+		return
+	}
+	if !r.canAddPublisherLocked(peer.id) {
+		r.mu.Unlock()
+		log.Printf("[ROOM %s] publisher limit reached, refusing peer %s", r.id, peer.id[:8])
+		peer.refuseTrack(receiver, "too many publishers")
+		return
+	}
+	if kind == mediaVideo && !peer.isHost() && r.hasOtherVideoLocked(peer.id, trackKey(peer.id, track)) {
+		r.mu.Unlock()
+		log.Printf("[ROOM %s] refusing second video track from peer %s (role=%s)", r.id, peer.id[:8], peer.role)
+		peer.refuseTrack(receiver, "only one video track allowed")
+		return
+	}
+	pub := NewPublishedTrack(peer, track, receiver, kind)
+	// A republish or renegotiation of the same track replaces it
+	replaced := r.published[pub.key]
 	r.published[pub.key] = pub
+	recorder := r.recorder
 	peers := make([]*Peer, 0, len(r.peers))
 	for _, other := range r.peers {
 		peers = append(peers, other)
 	}
 	r.mu.Unlock()
 
+	if replaced != nil {
+		log.Printf("[ROOM %s] track %s republished, replacing it", r.id, pub.key)
+		replaced.Stop()
+		for _, other := range peers {
+			other.RemoveSubscription(replaced.key)
+		}
+	}
 	pub.Start()
+	if recorder != nil {
+		recorder.AddTrack(pub)
+	}
+	r.refreshFollowers()
 
 	for _, other := range peers {
 		if other.id == peer.id {
@@ -174,6 +313,9 @@ func (r *Room) RemovePublishedTrack(publisherID string, streamID string) {
 		delete(r.published, key)
 		r.mu.Unlock()
 	}
+	if len(keysToRemove) > 0 {
+		r.refreshFollowers()
+	}
 }
 
 // RemovePublishedTracksByKind removes all published tracks of a specific kind for a publisher
@@ -182,7 +324,7 @@ func (r *Room) RemovePublishedTracksByKind(publisherID string, kind string) {
 	var keysToRemove []string
 	for key, pub := range r.published {
 		// Match by publisher ID and track kind
-		if pub.publisherID == publisherID && pub.remote.Kind().String() == kind {
+		if pub.publisherID == publisherID && pub.kind.String() == kind {
 			keysToRemove = append(keysToRemove, key)
 		}
 	}
@@ -211,4 +353,20 @@ func (r *Room) RemovePublishedTracksByKind(publisherID string, kind string) {
 		delete(r.published, key)
 		r.mu.Unlock()
 	}
+	if len(keysToRemove) > 0 {
+		r.refreshFollowers()
+	}
+}
+
+// SetLayer selects the simulcast layer subscriberID receives for the video
+// tracks of streamID (format: publisherId:originalStreamId).
+func (r *Room) SetLayer(subscriberID string, streamID string, rid string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, pub := range r.published {
+		if pub.streamID == streamID && pub.kind == webrtc.RTPCodecTypeVideo {
+			pub.SetSubscriberLayer(subscriberID, rid)
+		}
+	}
 }
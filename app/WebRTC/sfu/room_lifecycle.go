@@ -0,0 +1,194 @@
+package sfu
+
+import (
+	"log"
+	"time"
+)
+
+// RoomConfig controls how long rooms live and who may get in.
+type RoomConfig struct {
+	// MaxParticipants caps the peers in the room, hosts excepted (0 = unlimited).
+	MaxParticipants int `yaml:"maxParticipants" env:"ROOM_MAX_PARTICIPANTS"`
+	// MaxPublishers caps how many peers may publish media at once (0 = unlimited).
+	MaxPublishers int `yaml:"maxPublishers" env:"ROOM_MAX_PUBLISHERS"`
+	// MaxViewers caps the WHEP viewers, counted apart from the
+	// participants (0 = unlimited).
+	MaxViewers int `yaml:"maxViewers" env:"ROOM_MAX_VIEWERS"`
+	// Lobby holds non-host joiners in a waiting room until a host admits them.
+	Lobby bool `yaml:"lobby" env:"ROOM_LOBBY"`
+	// LastN limits the camera videos each peer receives to the N most recent
+	// active speakers plus pinned ones (0 = everybody), see last_n.go.
+	LastN int `yaml:"lastN" env:"ROOM_LAST_N"`
+	// Recording lets hosts record the room, see recorder.go.
+	Recording RecordingConfig `yaml:"recording"`
+	// Egress lets hosts live-stream the room as HLS, RTMP or SRT, see
+	// egress.go.
+	Egress EgressConfig `yaml:"egress"`
+	// Chat keeps and exports the chat of the room, see chat_log.go.
+	Chat ChatConfig `yaml:"chat"`
+	// ICE are the STUN/TURN servers of the peers, see ice.go.
+	ICE ICEConfig `yaml:"ice"`
+
+	// ResumeGrace is how long a peer that lost its connection is kept,
+	// unseen by the others, waiting for a resume (0 = removed at once),
+	// see resume.go.
+	ResumeGrace time.Duration `yaml:"resumeGrace" env:"ROOM_RESUME_GRACE"`
+	// ICERestartDelay is how long a disconnected PeerConnection may come
+	// back by itself before ICE is restarted, see ice_restart.go.
+	ICERestartDelay time.Duration `yaml:"iceRestartDelay" env:"ICE_RESTART_DELAY"`
+	// ICEFailureTimeout closes a peer whose PeerConnection has not
+	// reconnected this long after losing connectivity (0 = closed at once).
+	ICEFailureTimeout time.Duration `yaml:"iceFailureTimeout" env:"ICE_FAILURE_TIMEOUT"`
+	// EmptyTimeout is how long an empty room is kept around so that quick
+	// reconnects find it again before it is removed from the server.
+	EmptyTimeout time.Duration `yaml:"emptyTimeout" env:"ROOM_EMPTY_TIMEOUT"`
+	// MaxDuration is a hard limit on the lifetime of a room (0 = unlimited).
+	// Join tokens may shorten it with the scheduled end of the lesson.
+	MaxDuration time.Duration `yaml:"maxDuration" env:"ROOM_MAX_DURATION"`
+	// ClosingWarnings are the times before the deadline at which
+	// `room_closing` is broadcast to the participants.
+	ClosingWarnings []time.Duration `yaml:"closingWarnings"`
+
+	// signaling is Config.Signaling, copied by NewServer for the peers.
+	signaling SignalingConfig
+}
+
+// acquire takes a reference on the room for a joining connection. It must
+// be called with the server lock held so the room cannot be removed
+// concurrently. It returns false if the room is already closed.
+func (r *Room) acquire() bool {
+	r.lifeMu.Lock()
+	defer r.lifeMu.Unlock()
+
+	if r.closed {
+		return false
+	}
+	r.refs++
+	if r.emptyTimer != nil {
+		r.emptyTimer.Stop()
+		r.emptyTimer = nil
+	}
+	return true
+}
+
+// Release drops a reference taken by acquire. When the last one goes away
+// the room is removed after EmptyTimeout unless somebody joins again.
+func (r *Room) Release() {
+	r.lifeMu.Lock()
+	defer r.lifeMu.Unlock()
+
+	r.refs--
+	if r.refs > 0 || r.closed {
+		return
+	}
+	log.Printf("[ROOM %s] empty, removing in %s", r.id, r.cfg.EmptyTimeout)
+	r.emptyTimer = time.AfterFunc(r.cfg.EmptyTimeout, func() {
+		r.onEmpty(r)
+	})
+}
+
+// closeIfEmpty marks the room closed if nobody holds a reference. Called by
+// the server, with its lock held, when the empty timeout fires.
+func (r *Room) closeIfEmpty() bool {
+	r.lifeMu.Lock()
+	defer r.lifeMu.Unlock()
+
+	if r.refs > 0 || r.closed {
+		return false
+	}
+	r.closed = true
+	r.stopTimersLocked()
+	return true
+}
+
+// LimitUntil brings the room deadline forward to end if it is earlier than
+// the current one. Returns false if end has already passed.
+func (r *Room) LimitUntil(end time.Time) bool {
+	if !end.After(time.Now()) {
+		return false
+	}
+
+	r.lifeMu.Lock()
+	defer r.lifeMu.Unlock()
+
+	if r.closed {
+		return false
+	}
+	if !r.deadline.IsZero() && !end.Before(r.deadline) {
+		return true
+	}
+	r.scheduleDeadlineLocked(end)
+	return true
+}
+
+func (r *Room) scheduleDeadlineLocked(deadline time.Time) {
+	for _, t := range r.deadlineTimers {
+		t.Stop()
+	}
+	r.deadlineTimers = nil
+	r.deadline = deadline
+
+	log.Printf("[ROOM %s] closes at %s", r.id, deadline.Format(time.RFC3339))
+	for _, before := range r.cfg.ClosingWarnings {
+		delay := time.Until(deadline.Add(-before))
+		if delay <= 0 {
+			continue
+		}
+		r.deadlineTimers = append(r.deadlineTimers, time.AfterFunc(delay, func() {
+			r.BroadcastToAll(Signal{
+				Type:     "room_closing",
+				ClosesAt: deadline.Unix(),
+				Message:  "room closes in " + before.String(),
+			})
+		}))
+	}
+	r.deadlineTimers = append(r.deadlineTimers, time.AfterFunc(time.Until(deadline), r.expire))
+}
+
+// expire ends the room when its deadline is reached: everyone is told and
+// disconnected, and the room is removed from the server right away.
+func (r *Room) expire() {
+	r.lifeMu.Lock()
+	if r.closed {
+		r.lifeMu.Unlock()
+		return
+	}
+	r.closed = true
+	r.stopTimersLocked()
+	r.lifeMu.Unlock()
+
+	log.Printf("[ROOM %s] max duration reached, closing", r.id)
+	r.mu.RLock()
+	peers := make([]*Peer, 0, len(r.peers)+len(r.lobby))
+	for _, peer := range r.peers {
+		peers = append(peers, peer)
+	}
+	for _, peer := range r.lobby {
+		peers = append(peers, peer)
+	}
+	r.mu.RUnlock()
+
+	for _, peer := range peers {
+		peer.SendAndClose(Signal{Type: "room_closed", Message: "room reached its end time"})
+	}
+	r.onExpire(r)
+}
+
+// shutdown releases what the room still holds once the server dropped it.
+func (r *Room) shutdown() {
+	r.StopRecording()
+	r.StopEgress("")
+	r.closeViewers()
+	r.chat.close()
+}
+
+func (r *Room) stopTimersLocked() {
+	if r.emptyTimer != nil {
+		r.emptyTimer.Stop()
+		r.emptyTimer = nil
+	}
+	for _, t := range r.deadlineTimers {
+		t.Stop()
+	}
+	r.deadlineTimers = nil
+}
@@ -3,6 +3,7 @@ package sfu
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"sync"
@@ -14,20 +15,26 @@ import (
 	"github.com/pion/webrtc/v3"
 )
 
-const (
-	writeWait  = 10 * time.Second
-	pongWait   = 30 * time.Second
-	pingPeriod = (pongWait * 9) / 10
+var (
+	errInvalidJoin         = errors.New("invalid join parameters")
+	errAuthorizationFailed = errors.New("authorization failed")
+	errAccessDenied        = errors.New("access denied")
 )
 
 type Server struct {
-	api      *webrtc.API
-	rooms    map[string]*Room
-	mu       sync.RWMutex
-	upgrader websocket.Upgrader
+	cfg        Config
+	api        *webrtc.API
+	authorizer Authorizer
+	tokens     *TokenVerifier
+	rooms      map[string]*Room
+	mu         sync.RWMutex
+	upgrader   websocket.Upgrader
 }
 
-func NewServer() *Server {
+// NewServer creates the SFU. tokens may be nil, in which case the identity
+// sent by the client in `join` is trusted as-is (development setups).
+func NewServer(cfg Config, authorizer Authorizer, tokens *TokenVerifier) *Server {
+	cfg.Rooms.signaling = cfg.Signaling
 	media := &webrtc.MediaEngine{}
 	if err := media.RegisterDefaultCodecs(); err != nil {
 		log.Fatal(err)
@@ -35,6 +42,9 @@ func NewServer() *Server {
 	if err := media.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: "urn:ietf:params:rtp-hdrext:sdes:mid"}, webrtc.RTPCodecTypeAudio); err != nil {
 		log.Fatal(err)
 	}
+	if err := media.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: audioLevelURI}, webrtc.RTPCodecTypeAudio); err != nil {
+		log.Fatal(err)
+	}
 	if err := media.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: "urn:ietf:params:rtp-hdrext:sdes:mid"}, webrtc.RTPCodecTypeVideo); err != nil {
 		log.Fatal(err)
 	}
@@ -48,14 +58,22 @@ func NewServer() *Server {
 	if err := webrtc.RegisterDefaultInterceptors(media, registry); err != nil {
 		log.Fatal(err)
 	}
+	settings, err := cfg.Network.settingEngine()
+	if err != nil {
+		log.Fatal(err)
+	}
 	api := webrtc.NewAPI(
 		webrtc.WithMediaEngine(media),
 		webrtc.WithInterceptorRegistry(registry),
+		webrtc.WithSettingEngine(settings),
 	)
 
 	return &Server{
-		api:   api,
-		rooms: map[string]*Room{},
+		cfg:        cfg,
+		api:        api,
+		authorizer: authorizer,
+		tokens:     tokens,
+		rooms:      map[string]*Room{},
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				origin := r.Header.Get("Origin")
@@ -84,9 +102,9 @@ func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
-	// Limitar a 64KB para prevenir ataques de memoria/DoS
-	const maxMessageSize = 64 * 1024
-	conn.SetReadLimit(int64(maxMessageSize))
+	// Limitar el tamaño de los mensajes para prevenir ataques de memoria/DoS
+	pongWait := s.cfg.Signaling.PongWait
+	conn.SetReadLimit(s.cfg.Signaling.MaxMessageSize)
 	_ = conn.SetReadDeadline(time.Now().Add(pongWait))
 	conn.SetPongHandler(func(string) error {
 		return conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -105,70 +123,177 @@ func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validar campos requeridos y longitud
-	const maxStringLen = 256
-	if join.Type != "join" || join.SessionID == "" || join.UserID == "" ||
-	   len(join.SessionID) > maxStringLen || len(join.UserID) > maxStringLen {
+	if join.Type == "resume" {
+		s.resume(conn, join)
+		return
+	}
+	if join.Type != "join" {
 		_ = sendJSON(conn, Signal{Type: "error", Message: "invalid join parameters"})
 		return
 	}
 
-	// Authorize user (with 5-second timeout for DB/external calls)
-	authCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	authorized, err := AuthorizeUser(authCtx, join.UserID, join.SessionID)
-	cancel()
-
+	role, lessonEnd, err := s.identify(&join)
 	if err != nil {
-		log.Printf("authorization error for user=%s session=%s: %v", join.UserID, join.SessionID, err)
-		_ = sendJSON(conn, Signal{Type: "error", Message: "authorization failed"})
+		_ = sendJSON(conn, Signal{Type: "error", Message: err.Error()})
 		return
 	}
 
-	if !authorized {
-		log.Printf("authorization denied for user=%s session=%s", join.UserID, join.SessionID)
-		_ = sendJSON(conn, Signal{Type: "error", Message: "access denied"})
+	room := s.getOrCreateRoom(join.SessionID)
+	defer room.Release()
+
+	if lessonEnd != 0 && !room.LimitUntil(time.Unix(lessonEnd, 0)) {
+		_ = sendJSON(conn, Signal{Type: "error", Message: "room closed"})
+		return
+	}
+	if room.IsBanned(join.UserID) {
+		log.Printf("banned user=%s tried to join session=%s", join.UserID, join.SessionID)
+		_ = sendJSON(conn, Signal{Type: "error", Message: "banned"})
+		return
+	}
+
+	if room.IsFull(role) {
+		_ = sendJSON(conn, Signal{Type: "error", Message: ErrRoomFull.Error()})
 		return
 	}
 
-	room := s.getOrCreateRoom(join.SessionID)
 	peerID := uuid.NewString()
-	peer, err := NewPeer(peerID, join.UserID, join.UserName, room, conn, s.api)
+	peer, err := NewPeer(peerID, join.UserID, join.UserName, role, !s.cfg.StudentsMuted, !s.cfg.StudentsAudioOnly, room, conn, s.api)
 	if err != nil {
 		_ = sendJSON(conn, Signal{Type: "error", Message: "peer setup failed"})
 		return
 	}
 
-	log.Printf("peer connected user=%s session=%s peer=%s", join.UserID, join.SessionID, peerID)
-	defer log.Printf("peer disconnected user=%s session=%s peer=%s", join.UserID, join.SessionID, peerID)
+	log.Printf("peer connected user=%s session=%s peer=%s role=%s", join.UserID, join.SessionID, peerID, role)
 
-	room.AddPeer(peer)
-	_ = peer.Send(Signal{Type: "peer_list", Users: room.SnapshotUsers(peerID)})
-	info := peer.userInfo()
-	// Broadcast peer_joined to all peers including originator for consistency
-	room.BroadcastToAll(Signal{Type: "peer_joined", PeerID: info.PeerID, UserID: info.UserID, UserName: info.UserName, AudioEnabled: info.AudioEnabled, VideoEnabled: info.VideoEnabled, ScreenEnabled: info.ScreenEnabled, Speaking: info.Speaking})
-	_ = peer.Send(Signal{Type: "joined", PeerID: peerID})
+	if room.UsesLobby(role) {
+		// Signals are ignored until a host admits the peer (Room.Join)
+		peer.setWaiting(true)
+		room.EnterLobby(peer)
+	} else if err := room.Join(peer); err != nil {
+		_ = sendJSON(conn, Signal{Type: "error", Message: err.Error()})
+		peer.Close()
+		return
+	}
 
 	peer.Start()
-	peer.ReadLoop()
+	s.serve(room, peer, conn, 0)
+}
+
+// identify establishes who is joining: from the signed token when tokens
+// are enabled, then through the authorizer. join is completed with the
+// resulting identity. The error is the message to send back.
+func (s *Server) identify(join *Signal) (Role, int64, error) {
+	// Con tokens habilitados la identidad sale únicamente de los claims firmados
+	var lessonEnd int64
+	if s.tokens != nil {
+		claims, err := s.tokens.Verify(join.Token)
+		if err == nil && join.SessionID != "" && join.SessionID != claims.SessionID {
+			err = ErrTokenSessionMismatch
+		}
+		if err != nil {
+			log.Printf("join token rejected session=%s: %v", join.SessionID, err)
+			return "", 0, err
+		}
+		join.UserID = claims.UserID
+		join.UserName = claims.UserName
+		join.SessionID = claims.SessionID
+		join.Role = claims.Role
+		lessonEnd = claims.EndsAt
+	} else {
+		// The client cannot pick its own role
+		join.Role = ""
+	}
 
-	room.RemovePeer(peerID)
-	peer.Close()
+	// Validar campos requeridos y longitud
+	maxStringLen := s.cfg.Signaling.MaxFieldLength
+	if join.SessionID == "" || join.UserID == "" ||
+	   len(join.SessionID) > maxStringLen || len(join.UserID) > maxStringLen || len(join.UserName) > maxStringLen {
+		return "", 0, errInvalidJoin
+	}
+
+	// Authorize user (with a timeout for DB/external calls)
+	authCtx, cancel := context.WithTimeout(context.Background(), s.cfg.Signaling.AuthTimeout)
+	result, err := s.authorizer.Authorize(authCtx, AuthRequest{
+		UserID:      join.UserID,
+		SessionID:   join.SessionID,
+		AccessToken: join.AccessToken,
+	})
+	cancel()
+
+	if err != nil {
+		log.Printf("authorization error for user=%s session=%s: %v", join.UserID, join.SessionID, err)
+		return "", 0, errAuthorizationFailed
+	}
+
+	// A signed token and an access token must belong to the same user
+	if result.Authorized && result.UserID != "" && s.tokens != nil && result.UserID != join.UserID {
+		log.Printf("authorization identity mismatch token_user=%s auth_user=%s session=%s", join.UserID, result.UserID, join.SessionID)
+		result.Authorized = false
+	}
+
+	if !result.Authorized {
+		log.Printf("authorization denied for user=%s session=%s", join.UserID, join.SessionID)
+		return "", 0, errAccessDenied
+	}
+
+	if result.UserID != "" {
+		join.UserID = result.UserID
+	}
+	if result.UserName != "" {
+		join.UserName = result.UserName
+	}
+	if result.Role != "" {
+		join.Role = result.Role
+	}
+	role := ParseRole(join.Role)
+	if role == "" {
+		role = s.cfg.DefaultRole
+	}
+	return role, lessonEnd, nil
 }
 
+// getOrCreateRoom returns the room for id with a reference taken on it; the
+// caller must Release it when its peer leaves.
 func (s *Server) getOrCreateRoom(id string) *Room {
 	s.mu.RLock()
 	room := s.rooms[id]
-	s.mu.RUnlock()
-	if room != nil {
+	if room != nil && room.acquire() {
+		s.mu.RUnlock()
 		return room
 	}
+	s.mu.RUnlock()
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if room = s.rooms[id]; room != nil {
+	if room = s.rooms[id]; room != nil && room.acquire() {
 		return room
 	}
-	room = NewRoom(id)
+	room = NewRoom(id, s.cfg.Rooms, s.removeEmptyRoom, s.removeRoom)
+	room.acquire()
 	s.rooms[id] = room
 	return room
 }
+
+func (s *Server) removeEmptyRoom(room *Room) {
+	s.mu.Lock()
+	if s.rooms[room.id] != room || !room.closeIfEmpty() {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.rooms, room.id)
+	log.Printf("[ROOM %s] removed (%d rooms left)", room.id, len(s.rooms))
+	s.mu.Unlock()
+
+	room.shutdown()
+}
+
+func (s *Server) removeRoom(room *Room) {
+	s.mu.Lock()
+	if s.rooms[room.id] == room {
+		delete(s.rooms, room.id)
+	}
+	log.Printf("[ROOM %s] removed (%d rooms left)", room.id, len(s.rooms))
+	s.mu.Unlock()
+
+	room.shutdown()
+}
@@ -11,27 +11,45 @@ type Signal struct {
 	UserID        string `json:"userId"`
 	UserName      string `json:"userName,omitempty"`
 	SessionID     string `json:"sessionId,omitempty"`
+	Token         string `json:"token,omitempty"`
+	AccessToken   string `json:"accessToken,omitempty"`
 	PeerID        string `json:"peerId"`
+	Role          string `json:"role,omitempty"`
 	Target        string `json:"target,omitempty"`
 	Users         []UserInfo `json:"users,omitempty"`
 	AudioEnabled  bool   `json:"audioEnabled"`
 	VideoEnabled  bool   `json:"videoEnabled"`
 	ScreenEnabled bool   `json:"screenEnabled"`
 	Speaking      bool   `json:"speaking"`
+	VideoAllowed  bool   `json:"videoAllowed,omitempty"`
+	AudioAllowed  bool   `json:"audioAllowed,omitempty"`
 	ScreenStreamID string `json:"screenStreamId,omitempty"`
 	TrackKind     string `json:"trackKind,omitempty"`
 	StreamID      string `json:"streamId,omitempty"`
+	Layer         string `json:"layer,omitempty"`
+	Layers        []string `json:"layers,omitempty"`
 	SDP           string `json:"sdp,omitempty"`
 	Candidate     string `json:"candidate,omitempty"`
 	SDPMid        string `json:"sdpMid,omitempty"`
 	SDPMLineIndex uint16 `json:"sdpMLineIndex,omitempty"`
 	Message       string `json:"message,omitempty"`
+	ClosesAt      int64  `json:"closesAt,omitempty"`
+	Egress        string `json:"egress,omitempty"`
+	EgressID      string `json:"egressId,omitempty"`
+	URL           string `json:"url,omitempty"`
+	Count         int    `json:"count,omitempty"`
+	Messages      []DataMessage `json:"messages,omitempty"`
+	Hands         []HandRaise `json:"hands,omitempty"`
+	ResumeToken   string `json:"resumeToken,omitempty"`
+	ResumeGrace   int64  `json:"resumeGrace,omitempty"` // ms
+	ICEServers    []ICEServer `json:"iceServers,omitempty"`
 }
 
 type UserInfo struct {
 	PeerID        string `json:"peerId"`
 	UserID        string `json:"userId"`
 	UserName      string `json:"userName,omitempty"`
+	Role          string `json:"role,omitempty"`
 	AudioEnabled  bool   `json:"audioEnabled"`
 	VideoEnabled  bool   `json:"videoEnabled"`
 	ScreenEnabled bool   `json:"screenEnabled"`
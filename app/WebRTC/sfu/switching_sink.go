@@ -0,0 +1,91 @@
+package sfu
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// switchingSink forwards a stream whose source changes over time (camera
+// to screen share, one speaker to the next) as one continuous stream with
+// a fixed SSRC and payload type: sequence numbers and timestamps continue
+// across a switch, and video restarts on a keyframe. Egress and WHEP
+// viewers subscribe it to the PublishedTrack they currently follow.
+type switchingSink struct {
+	out         rtpWriter
+	payloadType uint8
+	ssrc        uint32
+	clockRate   uint32
+	mimeType    string
+	video       bool
+
+	mu        sync.Mutex
+	switching bool
+	waitKey   bool
+	started   bool
+	lastSeq   uint16
+	lastTS    uint32
+	lastAt    time.Time
+	seqOffset uint16
+	tsOffset  uint32
+}
+
+func newSwitchingSink(out rtpWriter, payloadType uint8, ssrc uint32, clockRate uint32, mimeType string) *switchingSink {
+	return &switchingSink{
+		out:         out,
+		payloadType: payloadType,
+		ssrc:        ssrc,
+		clockRate:   clockRate,
+		mimeType:    mimeType,
+		video:       strings.HasPrefix(strings.ToLower(mimeType), "video/"),
+	}
+}
+
+// switchSource makes the next packet start a new source.
+func (s *switchingSink) switchSource() {
+	s.mu.Lock()
+	s.switching = true
+	s.waitKey = s.video
+	s.mu.Unlock()
+}
+
+func (s *switchingSink) WriteRTP(pkt *rtp.Packet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.waitKey {
+		if !isKeyframe(s.mimeType, pkt.Payload) {
+			return nil
+		}
+		s.waitKey = false
+	}
+	if s.switching {
+		s.switching = false
+		if s.started {
+			// Continue right after the last packet, as much later as it
+			// really was
+			elapsed := uint32(time.Since(s.lastAt).Seconds() * float64(s.clockRate))
+			if elapsed == 0 {
+				elapsed = 1
+			}
+			s.seqOffset = s.lastSeq + 1 - pkt.SequenceNumber
+			s.tsOffset = s.lastTS + elapsed - pkt.Timestamp
+		}
+	}
+
+	out := rtp.Packet{Header: pkt.Header, Payload: pkt.Payload}
+	out.Extension = false
+	out.Extensions = nil
+	out.SSRC = s.ssrc
+	out.PayloadType = s.payloadType
+	out.SequenceNumber = pkt.SequenceNumber + s.seqOffset
+	out.Timestamp = pkt.Timestamp + s.tsOffset
+
+	s.started = true
+	s.lastSeq = out.SequenceNumber
+	s.lastTS = out.Timestamp
+	s.lastAt = time.Now()
+	return s.out.WriteRTP(&out)
+}
@@ -0,0 +1,186 @@
+package sfu
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTokenMissing         = errors.New("token required")
+	ErrTokenInvalid         = errors.New("invalid token")
+	ErrTokenExpired         = errors.New("token expired")
+	ErrTokenSessionMismatch = errors.New("token session mismatch")
+)
+
+// JoinClaims is the identity minted by the Laravel application for a single
+// lesson. The SFU trusts these values instead of the ones sent in `join`.
+type JoinClaims struct {
+	UserID    string `json:"sub"`
+	UserName  string `json:"name"`
+	Role      string `json:"role"`
+	SessionID string `json:"sid"`
+	EndsAt    int64  `json:"end,omitempty"` // scheduled end of the lesson
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+}
+
+// TokenConfig configures join token verification. Either a shared HMAC
+// secret (HS256) or a PEM public key file (RS256/ES256) enables it.
+type TokenConfig struct {
+	Secret        string        `yaml:"secret" env:"JOIN_TOKEN_SECRET" redact:"true"`
+	PublicKeyFile string        `yaml:"publicKeyFile" env:"JOIN_TOKEN_PUBLIC_KEY_FILE"`
+	Leeway        time.Duration `yaml:"leeway" env:"JOIN_TOKEN_LEEWAY"` // allowed clock skew for exp/nbf
+}
+
+// TokenVerifier checks signed join tokens (compact JWS / JWT).
+type TokenVerifier struct {
+	alg    string
+	secret []byte
+	rsaKey *rsa.PublicKey
+	ecKey  *ecdsa.PublicKey
+	leeway time.Duration
+	now    func() time.Time
+}
+
+// NewTokenVerifier returns nil when cfg has no key material, meaning that
+// join tokens are disabled and the client-supplied identity is used.
+func NewTokenVerifier(cfg TokenConfig) (*TokenVerifier, error) {
+	v := &TokenVerifier{leeway: cfg.Leeway, now: time.Now}
+
+	switch {
+	case cfg.Secret != "" && cfg.PublicKeyFile != "":
+		return nil, errors.New("token secret and public key file are mutually exclusive")
+	case cfg.Secret != "":
+		v.alg = "HS256"
+		v.secret = []byte(cfg.Secret)
+	case cfg.PublicKeyFile != "":
+		data, err := os.ReadFile(cfg.PublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read token public key: %w", err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("token public key %s is not PEM encoded", cfg.PublicKeyFile)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse token public key: %w", err)
+		}
+		switch k := key.(type) {
+		case *rsa.PublicKey:
+			v.alg = "RS256"
+			v.rsaKey = k
+		case *ecdsa.PublicKey:
+			// ES256 is P-256 only; another curve would fail every token
+			if k.Curve != elliptic.P256() {
+				return nil, fmt.Errorf("token public key: ES256 needs a P-256 key, not %s", k.Curve.Params().Name)
+			}
+			v.alg = "ES256"
+			v.ecKey = k
+		default:
+			return nil, fmt.Errorf("unsupported token public key type %T", key)
+		}
+	default:
+		return nil, nil
+	}
+
+	return v, nil
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// Verify checks the signature and validity window of token and returns its
+// claims. Errors are one of ErrTokenMissing, ErrTokenInvalid or ErrTokenExpired.
+func (v *TokenVerifier) Verify(token string) (*JoinClaims, error) {
+	if token == "" {
+		return nil, ErrTokenMissing
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrTokenInvalid
+	}
+
+	var header tokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrTokenInvalid
+	}
+	// Never let the token choose the algorithm.
+	if header.Alg != v.alg {
+		return nil, ErrTokenInvalid
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	if !v.verifySignature(parts[0]+"."+parts[1], signature) {
+		return nil, ErrTokenInvalid
+	}
+
+	var claims JoinClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrTokenInvalid
+	}
+	// The role must be explicit, never the DefaultRole of the SFU
+	if claims.UserID == "" || claims.SessionID == "" || claims.ExpiresAt == 0 || ParseRole(claims.Role) == "" {
+		return nil, ErrTokenInvalid
+	}
+
+	now := v.now()
+	if now.After(time.Unix(claims.ExpiresAt, 0).Add(v.leeway)) {
+		return nil, ErrTokenExpired
+	}
+	if claims.NotBefore != 0 && now.Add(v.leeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, ErrTokenInvalid
+	}
+
+	return &claims, nil
+}
+
+func (v *TokenVerifier) verifySignature(signingInput string, signature []byte) bool {
+	digest := sha256.Sum256([]byte(signingInput))
+
+	switch v.alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write([]byte(signingInput))
+		return hmac.Equal(signature, mac.Sum(nil))
+	case "RS256":
+		return rsa.VerifyPKCS1v15(v.rsaKey, crypto.SHA256, digest[:], signature) == nil
+	case "ES256":
+		if len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(v.ecKey, digest[:], r, s)
+	}
+	return false
+}
+
+func decodeSegment(segment string, out interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,216 @@
+package sfu
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const tokenTestSecret = "shared-secret"
+
+// tokenTestNow is the clock of the verifiers under test.
+var tokenTestNow = time.Unix(1_760_000_000, 0)
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub":  "42",
+		"name": "Alice",
+		"role": "student",
+		"sid":  "1",
+		"iat":  tokenTestNow.Unix(),
+		"nbf":  tokenTestNow.Unix(),
+		"exp":  tokenTestNow.Add(time.Minute).Unix(),
+	}
+}
+
+// signToken builds a compact JWS with header alg, signed by sign.
+func signToken(t *testing.T, alg string, claims map[string]interface{}, sign func(input string) []byte) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return input + "." + base64.RawURLEncoding.EncodeToString(sign(input))
+}
+
+func hs256(secret string) func(string) []byte {
+	return func(input string) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(input))
+		return mac.Sum(nil)
+	}
+}
+
+func rs256(t *testing.T, key *rsa.PrivateKey) func(string) []byte {
+	return func(input string) []byte {
+		digest := sha256.Sum256([]byte(input))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	}
+}
+
+func es256(t *testing.T, key *ecdsa.PrivateKey) func(string) []byte {
+	return func(input string) []byte {
+		digest := sha256.Sum256([]byte(input))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature
+	}
+}
+
+// publicKeyFile writes the PEM public key of key to a temporary file.
+func publicKeyFile(t *testing.T, key crypto.PublicKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "token.pub")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTestVerifier(t *testing.T, cfg TokenConfig) *TokenVerifier {
+	t.Helper()
+	v, err := NewTokenVerifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.now = func() time.Time { return tokenTestNow }
+	return v
+}
+
+func TestTokenVerifier(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaFile := publicKeyFile(t, &rsaKey.PublicKey)
+	hsVerifier := newTestVerifier(t, TokenConfig{Secret: tokenTestSecret})
+	rsVerifier := newTestVerifier(t, TokenConfig{PublicKeyFile: rsaFile})
+	esVerifier := newTestVerifier(t, TokenConfig{PublicKeyFile: publicKeyFile(t, &ecKey.PublicKey)})
+	leewayVerifier := newTestVerifier(t, TokenConfig{Secret: tokenTestSecret, Leeway: 30 * time.Second})
+
+	with := func(key string, value interface{}) map[string]interface{} {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+	// An RS256 verifier that took its public key as an HMAC secret would
+	// accept a token signed with it
+	rsaPEM, err := os.ReadFile(rsaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		verifier *TokenVerifier
+		token    string
+		err      error
+	}{
+		{"valid HS256", hsVerifier, signToken(t, "HS256", validClaims(), hs256(tokenTestSecret)), nil},
+		{"valid RS256", rsVerifier, signToken(t, "RS256", validClaims(), rs256(t, rsaKey)), nil},
+		{"valid ES256", esVerifier, signToken(t, "ES256", validClaims(), es256(t, ecKey)), nil},
+		{"empty", hsVerifier, "", ErrTokenMissing},
+		{"not a JWS", hsVerifier, "a.b", ErrTokenInvalid},
+		{"alg none", hsVerifier, signToken(t, "none", validClaims(), func(string) []byte { return nil }), ErrTokenInvalid},
+		{"HS256 to an RS256 verifier", rsVerifier, signToken(t, "HS256", validClaims(), hs256(string(rsaPEM))), ErrTokenInvalid},
+		{"RS256 to an HS256 verifier", hsVerifier, signToken(t, "RS256", validClaims(), rs256(t, rsaKey)), ErrTokenInvalid},
+		{"bad HS256 signature", hsVerifier, signToken(t, "HS256", validClaims(), hs256("other-secret")), ErrTokenInvalid},
+		{"bad ES256 signature", esVerifier, signToken(t, "ES256", with("sub", "43"), func(input string) []byte {
+			return es256(t, ecKey)(input + "x")
+		}), ErrTokenInvalid},
+		{"expired", hsVerifier, signToken(t, "HS256", with("exp", tokenTestNow.Add(-10*time.Second).Unix()), hs256(tokenTestSecret)), ErrTokenExpired},
+		{"expired within leeway", leewayVerifier, signToken(t, "HS256", with("exp", tokenTestNow.Add(-10*time.Second).Unix()), hs256(tokenTestSecret)), nil},
+		{"expired beyond leeway", leewayVerifier, signToken(t, "HS256", with("exp", tokenTestNow.Add(-time.Minute).Unix()), hs256(tokenTestSecret)), ErrTokenExpired},
+		{"no exp", hsVerifier, signToken(t, "HS256", with("exp", nil), hs256(tokenTestSecret)), ErrTokenInvalid},
+		{"nbf in the future", hsVerifier, signToken(t, "HS256", with("nbf", tokenTestNow.Add(10*time.Second).Unix()), hs256(tokenTestSecret)), ErrTokenInvalid},
+		{"nbf within leeway", leewayVerifier, signToken(t, "HS256", with("nbf", tokenTestNow.Add(10*time.Second).Unix()), hs256(tokenTestSecret)), nil},
+		{"no role", hsVerifier, signToken(t, "HS256", with("role", nil), hs256(tokenTestSecret)), ErrTokenInvalid},
+		{"unknown role", hsVerifier, signToken(t, "HS256", with("role", "superuser"), hs256(tokenTestSecret)), ErrTokenInvalid},
+		{"no sub", hsVerifier, signToken(t, "HS256", with("sub", nil), hs256(tokenTestSecret)), ErrTokenInvalid},
+		{"no sid", hsVerifier, signToken(t, "HS256", with("sid", nil), hs256(tokenTestSecret)), ErrTokenInvalid},
+	}
+	for _, tt := range tests {
+		claims, err := tt.verifier.Verify(tt.token)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if tt.err == nil && (claims.UserID != "42" || claims.SessionID != "1" || claims.Role != "student") {
+			t.Errorf("%s: claims %+v", tt.name, claims)
+		}
+	}
+}
+
+func TestTokenVerifierRejectsOtherCurves(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTokenVerifier(TokenConfig{PublicKeyFile: publicKeyFile(t, &key.PublicKey)}); err == nil {
+		t.Fatal("P-384 key accepted for ES256")
+	}
+}
+
+func TestTokenSessionMismatch(t *testing.T) {
+	s := &Server{
+		cfg:        DefaultConfig(),
+		authorizer: AllowAllAuthorizer{},
+		tokens:     newTestVerifier(t, TokenConfig{Secret: tokenTestSecret}),
+	}
+	token := signToken(t, "HS256", validClaims(), hs256(tokenTestSecret))
+
+	join := &Signal{Type: "join", SessionID: "2", Token: token}
+	if _, _, err := s.identify(join); !errors.Is(err, ErrTokenSessionMismatch) {
+		t.Fatalf("token for session 1 joining 2: err = %v, want %v", err, ErrTokenSessionMismatch)
+	}
+
+	// The identity comes from the claims, not from join
+	join = &Signal{Type: "join", SessionID: "1", UserID: "1", UserName: "Mallory", Role: "host", Token: token}
+	role, _, err := s.identify(join)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role != RoleStudent || join.UserID != "42" || join.UserName != "Alice" {
+		t.Fatalf("role %s, user %s %q; want the claims", role, join.UserID, join.UserName)
+	}
+}
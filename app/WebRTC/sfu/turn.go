@@ -0,0 +1,300 @@
+package sfu
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/turn/v2"
+)
+
+// TURNConfig configures the TURN server embedded in the SFU binary, for
+// deployments without a coturn of their own. It is off unless a port is set.
+// It checks the same TURN REST credentials the SFU hands out in `joined`
+// (see ice.go) and is added to ICEConfig.Servers by StartTURN.
+type TURNConfig struct {
+	// UDPPort, TCPPort and TLSPort are the listening ports (0 = off).
+	// UDP and TCP usually share 3478, TLS uses 5349.
+	UDPPort int `yaml:"udpPort" env:"TURN_UDP_PORT"`
+	TCPPort int `yaml:"tcpPort" env:"TURN_TCP_PORT"`
+	TLSPort int `yaml:"tlsPort" env:"TURN_TLS_PORT"`
+	// CertFile and KeyFile are the TLS certificate, required with TLSPort.
+	CertFile string `yaml:"certFile" env:"TURN_CERT_FILE"`
+	KeyFile  string `yaml:"keyFile" env:"TURN_KEY_FILE"`
+	// PublicIP is the relay address given to clients.
+	PublicIP string `yaml:"publicIp" env:"TURN_PUBLIC_IP"`
+	// Host is the host of the URLs sent to clients, PublicIP by default.
+	// turns: URLs need the name on the certificate.
+	Host  string `yaml:"host" env:"TURN_HOST"`
+	Realm string `yaml:"realm" env:"TURN_REALM"`
+	// RelayMinPort and RelayMaxPort bound the UDP ports of the relays, to
+	// open them in the firewall (0 = any). TURN_RELAY_PORTS sets both as
+	// "min-max".
+	RelayMinPort int `yaml:"relayMinPort" env:"TURN_RELAY_MIN_PORT"`
+	RelayMaxPort int `yaml:"relayMaxPort" env:"TURN_RELAY_MAX_PORT"`
+	// UserQuota caps the client addresses a user relays from at once
+	// (0 = unlimited). A browser takes one per TURN URL, network interface
+	// and PeerConnection.
+	UserQuota int `yaml:"userQuota" env:"TURN_USER_QUOTA"`
+}
+
+// Enabled reports whether the embedded TURN server should run.
+func (c TURNConfig) Enabled() bool {
+	return c.UDPPort > 0 || c.TCPPort > 0 || c.TLSPort > 0
+}
+
+const (
+	defaultTURNRealm = "webrtc-sfu"
+	// turnClientIdle is how long a client address counts against the quota
+	// after its last authenticated request. Clients refresh allocations and
+	// permissions well within the 10 minute allocation lifetime.
+	turnClientIdle = 10 * time.Minute
+)
+
+var errTURNPublicIP = errors.New("turn: a public IPv4 address is required")
+
+// TURNServer is the running embedded TURN server.
+type TURNServer struct {
+	server *turn.Server
+}
+
+// StartTURN starts the embedded TURN server and adds it to ice. Without a
+// TURN secret in ice a random one is generated: the server only accepts
+// the credentials the SFU hands out, plus the static TURN credential of
+// ice, if any.
+func StartTURN(cfg TURNConfig, ice *ICEConfig) (*TURNServer, error) {
+	publicIP := net.ParseIP(cfg.PublicIP).To4()
+	if publicIP == nil {
+		return nil, errTURNPublicIP
+	}
+	if cfg.Realm == "" {
+		cfg.Realm = defaultTURNRealm
+	}
+	if cfg.Host == "" {
+		cfg.Host = cfg.PublicIP
+	}
+	if ice.TURNSecret == "" {
+		ice.TURNSecret = randomHex(32)
+	}
+
+	auth := &turnAuth{
+		secret: ice.TURNSecret,
+		quota:  turnQuota{limit: cfg.UserQuota, clients: make(map[string]*turnClient)},
+	}
+	for _, server := range ice.Servers {
+		if server.Credential != "" && hasTURNURL(server.URLs) {
+			auth.staticUser, auth.staticPassword = server.Username, server.Credential
+		}
+	}
+
+	relay := func() turn.RelayAddressGenerator {
+		if cfg.RelayMinPort > 0 && cfg.RelayMaxPort > 0 {
+			return &turn.RelayAddressGeneratorPortRange{
+				RelayAddress: publicIP,
+				Address:      "0.0.0.0",
+				MinPort:      uint16(cfg.RelayMinPort),
+				MaxPort:      uint16(cfg.RelayMaxPort),
+			}
+		}
+		return &turn.RelayAddressGeneratorStatic{RelayAddress: publicIP, Address: "0.0.0.0"}
+	}
+
+	serverConfig := turn.ServerConfig{Realm: cfg.Realm, AuthHandler: auth.handle}
+	var urls []string
+	// Listeners opened so far are closed if a later one fails
+	var opened []interface{ Close() error }
+	fail := func(err error) (*TURNServer, error) {
+		for _, l := range opened {
+			_ = l.Close()
+		}
+		return nil, fmt.Errorf("turn: %w", err)
+	}
+
+	if cfg.UDPPort > 0 {
+		conn, err := net.ListenPacket("udp4", ":"+strconv.Itoa(cfg.UDPPort))
+		if err != nil {
+			return fail(err)
+		}
+		opened = append(opened, conn)
+		serverConfig.PacketConnConfigs = append(serverConfig.PacketConnConfigs, turn.PacketConnConfig{
+			PacketConn:            conn,
+			RelayAddressGenerator: relay(),
+			PermissionHandler:     auth.permit,
+		})
+		urls = append(urls, fmt.Sprintf("turn:%s:%d?transport=udp", cfg.Host, cfg.UDPPort))
+	}
+	if cfg.TCPPort > 0 {
+		listener, err := net.Listen("tcp4", ":"+strconv.Itoa(cfg.TCPPort))
+		if err != nil {
+			return fail(err)
+		}
+		opened = append(opened, listener)
+		serverConfig.ListenerConfigs = append(serverConfig.ListenerConfigs, turn.ListenerConfig{
+			Listener:              listener,
+			RelayAddressGenerator: relay(),
+			PermissionHandler:     auth.permit,
+		})
+		urls = append(urls, fmt.Sprintf("turn:%s:%d?transport=tcp", cfg.Host, cfg.TCPPort))
+	}
+	if cfg.TLSPort > 0 {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return fail(err)
+		}
+		listener, err := tls.Listen("tcp4", ":"+strconv.Itoa(cfg.TLSPort), &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		})
+		if err != nil {
+			return fail(err)
+		}
+		opened = append(opened, listener)
+		serverConfig.ListenerConfigs = append(serverConfig.ListenerConfigs, turn.ListenerConfig{
+			Listener:              listener,
+			RelayAddressGenerator: relay(),
+			PermissionHandler:     auth.permit,
+		})
+		urls = append(urls, fmt.Sprintf("turns:%s:%d?transport=tcp", cfg.Host, cfg.TLSPort))
+	}
+
+	server, err := turn.NewServer(serverConfig)
+	if err != nil {
+		return fail(err)
+	}
+	ice.Servers = append(ice.Servers, ICEServer{URLs: urls})
+	log.Printf("[TURN] listening: %s (relay %s, ports %d-%d, quota %d)",
+		strings.Join(urls, " "), publicIP, cfg.RelayMinPort, cfg.RelayMaxPort, cfg.UserQuota)
+	return &TURNServer{server: server}, nil
+}
+
+// Close stops the server and its relays.
+func (t *TURNServer) Close() error {
+	return t.server.Close()
+}
+
+type turnAuth struct {
+	secret         string
+	staticUser     string
+	staticPassword string
+	quota          turnQuota
+}
+
+// handle is the turn.AuthHandler: it accepts unexpired TURN REST
+// credentials and the static credential. pion/turn checks the message
+// integrity after it returns, so the quota is only enforced in permit.
+func (a *turnAuth) handle(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+	if a.staticUser != "" && username == a.staticUser {
+		return turn.GenerateAuthKey(username, realm, a.staticPassword), true
+	}
+
+	expiry, userID, _ := strings.Cut(username, ":")
+	expires, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		log.Printf("[TURN] invalid username %q from %s", username, srcAddr)
+		return nil, false
+	}
+	now := time.Now()
+	if now.Unix() > expires {
+		log.Printf("[TURN] expired credential user=%s from %s", userID, srcAddr)
+		return nil, false
+	}
+	a.quota.seen(userID, srcAddr, now)
+	return turn.GenerateAuthKey(username, realm, turnRESTPassword(a.secret, username)), true
+}
+
+// permit is the turn.PermissionHandler, called for an authenticated client
+// with an allocation before it relays to peerIP. It keeps clients from
+// relaying to the server itself or to addresses that are never a WebRTC
+// peer, and users from relaying from more addresses than the quota.
+func (a *turnAuth) permit(clientAddr net.Addr, peerIP net.IP) bool {
+	if peerIP.IsLoopback() || peerIP.IsUnspecified() || peerIP.IsMulticast() || peerIP.IsLinkLocalUnicast() {
+		return false
+	}
+	if userID, ok := a.quota.allow(clientAddr, time.Now()); !ok {
+		log.Printf("[TURN] quota exceeded user=%s from %s", userID, clientAddr)
+		return false
+	}
+	return true
+}
+
+// turnQuota counts the client addresses each user relays from. An address
+// is attributed to the user of its last credential and counts once it gets
+// a permission, which forged requests never do. pion/turn does not tell
+// when an allocation goes away, so an address stops counting once it has
+// been idle for turnClientIdle.
+type turnQuota struct {
+	limit int
+
+	mu        sync.Mutex // Protege: clients, lastPrune
+	clients   map[string]*turnClient
+	lastPrune time.Time
+}
+
+type turnClient struct {
+	userID string
+	seen   time.Time
+	active bool // counted against the quota
+}
+
+func turnClientKey(addr net.Addr) string {
+	return addr.Network() + "/" + addr.String()
+}
+
+// seen records an authenticated request of userID from addr.
+func (q *turnQuota) seen(userID string, addr net.Addr, now time.Time) {
+	if q.limit <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if now.Sub(q.lastPrune) > time.Minute {
+		for key, client := range q.clients {
+			if now.Sub(client.seen) > turnClientIdle {
+				delete(q.clients, key)
+			}
+		}
+		q.lastPrune = now
+	}
+	key := turnClientKey(addr)
+	if client := q.clients[key]; client != nil && client.userID == userID {
+		client.seen = now
+		return
+	}
+	q.clients[key] = &turnClient{userID: userID, seen: now}
+}
+
+// allow counts addr against the quota of its user, if it is not counted
+// yet. Clients with the static credential are not counted.
+func (q *turnQuota) allow(addr net.Addr, now time.Time) (string, bool) {
+	if q.limit <= 0 {
+		return "", true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	client := q.clients[turnClientKey(addr)]
+	if client == nil {
+		return "", true
+	}
+	if client.active {
+		return client.userID, true
+	}
+	count := 0
+	for _, other := range q.clients {
+		if other.active && other.userID == client.userID && now.Sub(other.seen) <= turnClientIdle {
+			count++
+		}
+	}
+	if count >= q.limit {
+		return client.userID, false
+	}
+	client.active = true
+	return client.userID, true
+}
@@ -0,0 +1,399 @@
+package sfu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+// Matroska element IDs used by webmWriter.
+const (
+	ebmlHeaderID        = 0x1A45DFA3
+	ebmlVersionID       = 0x4286
+	ebmlReadVersionID   = 0x42F7
+	ebmlMaxIDLengthID   = 0x42F2
+	ebmlMaxSizeLengthID = 0x42F3
+	ebmlDocTypeID       = 0x4282
+	ebmlDocTypeVerID    = 0x4287
+	ebmlDocTypeReadID   = 0x4285
+	mkvSegmentID        = 0x18538067
+	mkvInfoID           = 0x1549A966
+	mkvTimecodeScaleID  = 0x2AD7B1
+	mkvMuxingAppID      = 0x4D80
+	mkvWritingAppID     = 0x5741
+	mkvDurationID       = 0x4489
+	mkvTracksID         = 0x1654AE6B
+	mkvTrackEntryID     = 0xAE
+	mkvTrackNumberID    = 0xD7
+	mkvTrackUIDID       = 0x73C5
+	mkvTrackTypeID      = 0x83
+	mkvCodecID          = 0x86
+	mkvVideoID          = 0xE0
+	mkvPixelWidthID     = 0xB0
+	mkvPixelHeightID    = 0xBA
+	mkvClusterID        = 0x1F43B675
+	mkvTimecodeID       = 0xE7
+	mkvSimpleBlockID    = 0xA3
+)
+
+const (
+	webmMuxingApp = "ConnectED SFU"
+	// webmClusterMax keeps block timecodes (int16, in ms) inside a cluster.
+	webmClusterMax = 10000
+)
+
+var errWebMCodec = errors.New("webm: only VP8 and VP9 are supported")
+
+// webmWriter writes a single VP8 or VP9 RTP stream to a WebM file. It is a
+// minimal muxer: the header is written on the first keyframe (which gives
+// the frame size), a cluster starts on every keyframe and the duration is
+// patched on Close. There are no cues, players seek by scanning.
+type webmWriter struct {
+	file    *os.File
+	codecID string
+	vp9     bool
+
+	headerWritten  bool
+	durationOffset int64
+
+	frame    []byte
+	frameKey bool
+	frameTS  uint32
+
+	started bool
+	lastRTP uint32
+	elapsed int64 // RTP ticks since the first frame
+
+	cluster     bytes.Buffer
+	clusterTime int64 // ms
+	lastTime    int64 // ms
+}
+
+func newWebMWriter(path string, mimeType string) (*webmWriter, error) {
+	w := &webmWriter{}
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		w.codecID = "V_VP8"
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		w.codecID = "V_VP9"
+		w.vp9 = true
+	default:
+		return nil, errWebMCodec
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w.file = file
+	return w, nil
+}
+
+// WriteRTP depacketizes pkt and writes a block every time a frame is
+// completed (marker bit). Frames before the first keyframe are dropped.
+func (w *webmWriter) WriteRTP(pkt *rtp.Packet) error {
+	if w.file == nil || len(pkt.Payload) == 0 {
+		return nil
+	}
+
+	var (
+		payload []byte
+		start   bool
+		err     error
+	)
+	if w.vp9 {
+		var vp9 codecs.VP9Packet
+		payload, err = vp9.Unmarshal(pkt.Payload)
+		start = vp9.B
+	} else {
+		var vp8 codecs.VP8Packet
+		payload, err = vp8.Unmarshal(pkt.Payload)
+		start = vp8.S == 1 && vp8.PID == 0
+	}
+	if err != nil {
+		return err
+	}
+
+	if start {
+		w.frame = w.frame[:0]
+		w.frameKey = isKeyframe(w.mimeType(), pkt.Payload)
+		w.frameTS = pkt.Timestamp
+	} else if len(w.frame) == 0 {
+		return nil // middle of a frame whose start was lost
+	}
+	w.frame = append(w.frame, payload...)
+
+	if !pkt.Marker {
+		return nil
+	}
+	frame := w.frame
+	w.frame = nil
+	return w.writeFrame(frame, w.frameKey, w.frameTS)
+}
+
+func (w *webmWriter) mimeType() string {
+	if w.vp9 {
+		return webrtc.MimeTypeVP9
+	}
+	return webrtc.MimeTypeVP8
+}
+
+func (w *webmWriter) writeFrame(frame []byte, keyframe bool, timestamp uint32) error {
+	if !w.headerWritten {
+		if !keyframe {
+			return nil
+		}
+		width, height, ok := w.frameSize(frame)
+		if !ok {
+			return nil
+		}
+		if err := w.writeHeader(width, height); err != nil {
+			return err
+		}
+	}
+
+	// Unwrap the 32-bit RTP clock (90kHz for video) into milliseconds
+	if w.started {
+		w.elapsed += int64(int32(timestamp - w.lastRTP))
+	}
+	w.started = true
+	w.lastRTP = timestamp
+	now := w.elapsed / 90
+	if now < w.lastTime {
+		now = w.lastTime
+	}
+	w.lastTime = now
+
+	if w.cluster.Len() > 0 && (keyframe || now-w.clusterTime >= webmClusterMax) {
+		if err := w.flushCluster(); err != nil {
+			return err
+		}
+	}
+	if w.cluster.Len() == 0 {
+		w.clusterTime = now
+		w.cluster.Write(ebmlUint(mkvTimecodeID, uint64(now)))
+	}
+
+	block := make([]byte, 4, 4+len(frame))
+	block[0] = 0x81 // track number 1
+	binary.BigEndian.PutUint16(block[1:3], uint16(int16(now-w.clusterTime)))
+	if keyframe {
+		block[3] = 0x80
+	}
+	block = append(block, frame...)
+	w.cluster.Write(ebmlElement(mkvSimpleBlockID, block))
+	return nil
+}
+
+func (w *webmWriter) frameSize(frame []byte) (uint16, uint16, bool) {
+	if w.vp9 {
+		return vp9FrameSize(frame)
+	}
+	// RFC 6386 section 9.1: 3-byte frame tag, start code, 14-bit sizes
+	if len(frame) < 10 || frame[3] != 0x9d || frame[4] != 0x01 || frame[5] != 0x2a {
+		return 0, 0, false
+	}
+	width := binary.LittleEndian.Uint16(frame[6:8]) & 0x3fff
+	height := binary.LittleEndian.Uint16(frame[8:10]) & 0x3fff
+	return width, height, true
+}
+
+func (w *webmWriter) writeHeader(width, height uint16) error {
+	var buf bytes.Buffer
+	buf.Write(ebmlElement(ebmlHeaderID, concat(
+		ebmlUint(ebmlVersionID, 1),
+		ebmlUint(ebmlReadVersionID, 1),
+		ebmlUint(ebmlMaxIDLengthID, 4),
+		ebmlUint(ebmlMaxSizeLengthID, 8),
+		ebmlString(ebmlDocTypeID, "webm"),
+		ebmlUint(ebmlDocTypeVerID, 4),
+		ebmlUint(ebmlDocTypeReadID, 2),
+	)))
+	// Segment of unknown size, clusters are appended as they come
+	buf.Write(ebmlID(mkvSegmentID))
+	buf.Write([]byte{0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	info := ebmlElement(mkvInfoID, concat(
+		ebmlUint(mkvTimecodeScaleID, 1000000), // 1ms
+		ebmlString(mkvMuxingAppID, webmMuxingApp),
+		ebmlString(mkvWritingAppID, webmMuxingApp),
+		ebmlFloat(mkvDurationID, 0),
+	))
+	buf.Write(info)
+	w.durationOffset = int64(buf.Len()) - 8
+
+	buf.Write(ebmlElement(mkvTracksID, ebmlElement(mkvTrackEntryID, concat(
+		ebmlUint(mkvTrackNumberID, 1),
+		ebmlUint(mkvTrackUIDID, 1),
+		ebmlUint(mkvTrackTypeID, 1), // video
+		ebmlString(mkvCodecID, w.codecID),
+		ebmlElement(mkvVideoID, concat(
+			ebmlUint(mkvPixelWidthID, uint64(width)),
+			ebmlUint(mkvPixelHeightID, uint64(height)),
+		)),
+	))))
+
+	if _, err := w.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	w.headerWritten = true
+	return nil
+}
+
+func (w *webmWriter) flushCluster() error {
+	if w.cluster.Len() == 0 {
+		return nil
+	}
+	_, err := w.file.Write(ebmlElement(mkvClusterID, w.cluster.Bytes()))
+	w.cluster.Reset()
+	return err
+}
+
+// Close writes the pending cluster and the duration. It is idempotent.
+func (w *webmWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	file := w.file
+	defer func() { w.file = nil }()
+
+	if w.headerWritten {
+		if err := w.flushCluster(); err != nil {
+			_ = file.Close()
+			return err
+		}
+		duration := make([]byte, 8)
+		binary.BigEndian.PutUint64(duration, math.Float64bits(float64(w.lastTime)))
+		if _, err := file.WriteAt(duration, w.durationOffset); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// vp9FrameSize reads the frame size from the uncompressed header of a VP9
+// keyframe (VP9 bitstream specification, section 6.2).
+func vp9FrameSize(frame []byte) (uint16, uint16, bool) {
+	r := bitReader{data: frame}
+	if r.read(2) != 2 { // frame_marker
+		return 0, 0, false
+	}
+	profile := r.read(1) | r.read(1)<<1
+	if profile == 3 {
+		r.read(1)
+	}
+	if r.read(1) == 1 { // show_existing_frame
+		return 0, 0, false
+	}
+	if r.read(1) != 0 { // frame_type: not a keyframe
+		return 0, 0, false
+	}
+	r.read(2) // show_frame, error_resilient_mode
+	if r.read(24) != 0x498342 {
+		return 0, 0, false
+	}
+	if profile >= 2 {
+		r.read(1) // ten_or_twelve_bit
+	}
+	if colorSpace := r.read(3); colorSpace != 7 { // not CS_RGB
+		r.read(1) // color_range
+		if profile == 1 || profile == 3 {
+			r.read(3) // subsampling_x, subsampling_y, reserved_zero
+		}
+	} else if profile == 1 || profile == 3 {
+		r.read(1)
+	}
+	width := r.read(16) + 1
+	height := r.read(16) + 1
+	if r.overflow {
+		return 0, 0, false
+	}
+	return uint16(width), uint16(height), true
+}
+
+type bitReader struct {
+	data     []byte
+	pos      int // in bits
+	overflow bool
+}
+
+func (r *bitReader) read(bits int) uint32 {
+	var value uint32
+	for i := 0; i < bits; i++ {
+		if r.pos/8 >= len(r.data) {
+			r.overflow = true
+			return 0
+		}
+		bit := (r.data[r.pos/8] >> (7 - uint(r.pos%8))) & 1
+		value = value<<1 | uint32(bit)
+		r.pos++
+	}
+	return value
+}
+
+func ebmlID(id uint32) []byte {
+	switch {
+	case id > 0xFFFFFF:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFFFF:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFF:
+		return []byte{byte(id >> 8), byte(id)}
+	}
+	return []byte{byte(id)}
+}
+
+// ebmlSize encodes a data size as a variable length integer.
+func ebmlSize(size uint64) []byte {
+	length := 1
+	for length < 8 && size >= (uint64(1)<<(7*uint(length)))-1 {
+		length++
+	}
+	out := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		out[i] = byte(size)
+		size >>= 8
+	}
+	out[0] |= 0x80 >> uint(length-1)
+	return out
+}
+
+func ebmlElement(id uint32, payload []byte) []byte {
+	return concat(ebmlID(id), ebmlSize(uint64(len(payload))), payload)
+}
+
+func ebmlUint(id uint32, value uint64) []byte {
+	var payload []byte
+	for shift := 56; shift >= 0; shift -= 8 {
+		if b := byte(value >> uint(shift)); b != 0 || len(payload) > 0 || shift == 0 {
+			payload = append(payload, b)
+		}
+	}
+	return ebmlElement(id, payload)
+}
+
+func ebmlFloat(id uint32, value float64) []byte {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, math.Float64bits(value))
+	return ebmlElement(id, payload)
+}
+
+func ebmlString(id uint32, value string) []byte {
+	return ebmlElement(id, []byte(value))
+}
+
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, part := range parts {
+		out = append(out, part...)
+	}
+	return out
+}
@@ -0,0 +1,584 @@
+package sfu
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// WHEP egress (draft-ietf-wish-whep) for watch-only attendees and kiosks:
+//
+//	POST   /whep/{sessionId}            SDP offer -> 201 + answer, Location
+//	PATCH  /whep/{sessionId}/{viewerId} trickle ICE candidates
+//	DELETE /whep/{sessionId}/{viewerId} leave
+//
+// A viewer is not a Peer: it has a single PeerConnection, no signaling, and
+// is counted apart from the participants (RoomConfig.MaxViewers, `viewers`
+// signal). WHEP has no renegotiation, so every audio and video m-line of
+// the offer becomes a fixed slot and the viewer switches what each slot
+// carries as the room changes: video follows the host screen share, then
+// the host camera, then the cameras of the latest speakers; audio follows
+// the dominant speaker, then the hosts, then the latest speakers. Audio is
+// not mixed: a player that offers a single audio m-line hears whoever
+// holds the dominant spot, and needs more audio m-lines to hear people
+// talking over each other.
+const (
+	whepPathPrefix       = "/whep/"
+	whepSelectInterval   = time.Second
+	whepDefaultVideoMime = webrtc.MimeTypeVP8
+)
+
+var ErrTooManyViewers = errors.New("too many viewers")
+
+type whepViewer struct {
+	id     string
+	userID string
+	room   *Room
+	pc     *webrtc.PeerConnection
+	subID  string
+
+	mu    sync.Mutex
+	slots []*whepSlot
+
+	iceMu   sync.Mutex  // Protege: iceFail
+	iceFail *time.Timer // while the connection is down, see onConnectionStateChange
+
+	refresh   chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type whepSlot struct {
+	kind   webrtc.RTPCodecType
+	mime   string
+	sink   *switchingSink
+	source *PublishedTrack // protected by whepViewer.mu
+}
+
+// HandleWHEP serves the WHEP endpoint and its resources under /whep/.
+func (s *Server) HandleWHEP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Link")
+
+	parts, ok := resourcePath(r, whepPathPrefix)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case r.Method == http.MethodOptions:
+		w.Header().Set("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.Header().Set("Accept-Post", "application/sdp")
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 1 && parts[0] != "" && r.Method == http.MethodPost:
+		s.whepSubscribe(w, r, parts[0])
+	case len(parts) == 2 && r.Method == http.MethodPatch:
+		viewer := s.whepViewer(parts[0], parts[1])
+		if viewer == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/trickle-ice-sdpfrag") {
+			http.Error(w, "expected application/trickle-ice-sdpfrag", http.StatusUnsupportedMediaType)
+			return
+		}
+		frag, err := io.ReadAll(io.LimitReader(r.Body, whipMaxBody))
+		if err != nil {
+			http.Error(w, "invalid sdpfrag", http.StatusBadRequest)
+			return
+		}
+		if err := addTrickleCandidates(viewer.pc, string(frag)); err != nil {
+			log.Printf("[ROOM %s] WHEP viewer %s candidate rejected: %v", viewer.room.id, viewer.id[:8], err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		viewer := s.whepViewer(parts[0], parts[1])
+		if viewer == nil {
+			http.NotFound(w, r)
+			return
+		}
+		viewer.Close()
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) whepSubscribe(w http.ResponseWriter, r *http.Request, sessionID string) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+		http.Error(w, "expected application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+	offer, err := io.ReadAll(io.LimitReader(r.Body, whipMaxBody))
+	if err != nil || len(offer) == 0 {
+		http.Error(w, "invalid offer", http.StatusBadRequest)
+		return
+	}
+
+	join, role, lessonEnd, err := s.identifyHTTP(r, sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), identifyStatus(err))
+		return
+	}
+
+	room := s.getOrCreateRoom(join.SessionID)
+	release := true
+	defer func() {
+		if release {
+			room.Release()
+		}
+	}()
+
+	switch {
+	case lessonEnd != 0 && !room.LimitUntil(time.Unix(lessonEnd, 0)):
+		http.Error(w, "room closed", http.StatusForbidden)
+		return
+	case room.IsBanned(join.UserID):
+		http.Error(w, "banned", http.StatusForbidden)
+		return
+	case room.UsesLobby(role):
+		http.Error(w, "the lobby is not supported over WHEP", http.StatusForbidden)
+		return
+	}
+
+	viewer, answer, err := newWHEPViewer(s.api, room, join.UserID, string(offer))
+	if err != nil {
+		log.Printf("[ROOM %s] WHEP offer rejected: %v", room.id, err)
+		http.Error(w, "invalid offer", http.StatusBadRequest)
+		return
+	}
+	if err := room.addViewer(viewer); err != nil {
+		_ = viewer.pc.Close()
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	log.Printf("[ROOM %s] WHEP viewer %s joined user=%s", room.id, viewer.id[:8], join.UserID)
+	release = false
+	go viewer.run()
+
+	for _, link := range iceLinkHeaders(room.cfg.ICE.serversFor(join.UserID, time.Now())) {
+		w.Header().Add("Link", link)
+	}
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", whepPathPrefix+url.PathEscape(sessionID)+"/"+viewer.id)
+	w.WriteHeader(http.StatusCreated)
+	_, _ = io.WriteString(w, answer)
+}
+
+// newWHEPViewer creates the PeerConnection of a viewer with one sending
+// track per m-line of the offer and returns the complete answer.
+func newWHEPViewer(api *webrtc.API, room *Room, userID string, sdp string) (*whepViewer, string, error) {
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}
+	parsed, err := offer.Unmarshal()
+	if err != nil {
+		return nil, "", err
+	}
+
+	pc, err := api.NewPeerConnection(room.cfg.ICE.peerConnectionConfig())
+	if err != nil {
+		return nil, "", err
+	}
+	id := uuid.NewString()
+	v := &whepViewer{
+		id:      id,
+		userID:  userID,
+		room:    room,
+		pc:      pc,
+		subID:   "whep:" + id,
+		refresh: make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+
+	videoMime := whepVideoMime(room, sdp)
+	for i, media := range parsed.MediaDescriptions {
+		var capability webrtc.RTPCodecCapability
+		var kind webrtc.RTPCodecType
+		switch media.MediaName.Media {
+		case "audio":
+			kind = webrtc.RTPCodecTypeAudio
+			capability = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+		case "video":
+			kind = webrtc.RTPCodecTypeVideo
+			capability = webrtc.RTPCodecCapability{MimeType: videoMime, ClockRate: 90000}
+		default:
+			continue
+		}
+		track, err := webrtc.NewTrackLocalStaticRTP(capability, fmt.Sprintf("%s-%d", kind, i), "room")
+		if err != nil {
+			_ = pc.Close()
+			return nil, "", err
+		}
+		sender, err := pc.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+		if err != nil {
+			_ = pc.Close()
+			return nil, "", err
+		}
+		slot := &whepSlot{
+			kind: kind,
+			mime: capability.MimeType,
+			sink: newSwitchingSink(track, 0, 0, capability.ClockRate, capability.MimeType),
+		}
+		v.slots = append(v.slots, slot)
+		go v.readRTCP(sender.Sender(), slot)
+	}
+	if len(v.slots) == 0 {
+		_ = pc.Close()
+		return nil, "", errors.New("no audio or video in the offer")
+	}
+
+	pc.OnConnectionStateChange(v.onConnectionStateChange)
+
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		_ = pc.Close()
+		return nil, "", err
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		_ = pc.Close()
+		return nil, "", err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		_ = pc.Close()
+		return nil, "", err
+	}
+	select {
+	case <-gathered:
+	case <-time.After(whipGatherTimeout):
+	}
+	return v, pc.LocalDescription().SDP, nil
+}
+
+// whepVideoMime picks the video codec of a viewer: the one of the video it
+// will most likely get first, if the offer accepts it.
+func whepVideoMime(room *Room, sdp string) string {
+	offered := func(mime string) bool {
+		name := strings.TrimPrefix(mime, "video/")
+		return strings.Contains(strings.ToUpper(sdp), " "+strings.ToUpper(name)+"/90000")
+	}
+	if videos, _ := room.whepSources("", 1, 0); len(videos) > 0 && offered(videos[0].codec.MimeType) {
+		return videos[0].codec.MimeType
+	}
+	for _, mime := range []string{webrtc.MimeTypeVP8, webrtc.MimeTypeH264, webrtc.MimeTypeVP9} {
+		if offered(mime) {
+			return mime
+		}
+	}
+	return whepDefaultVideoMime
+}
+
+// whepSources returns, best first, up to videoSlots videos in videoMime
+// (any codec when empty) and audioSlots audio tracks for the viewers.
+func (r *Room) whepSources(videoMime string, videoSlots, audioSlots int) (videos, audios []*PublishedTrack) {
+	r.speakerMu.Lock()
+	order := make(map[string]int, len(r.speakers))
+	for i, id := range r.speakers {
+		order[id] = i
+	}
+	dominant := r.dominant
+	r.speakerMu.Unlock()
+
+	// Hosts come first, screen shares before cameras, then the speakers in
+	// the order they last spoke. The dominant speaker goes before the hosts
+	// for audio, so that the first audio slot carries whoever is talking.
+	rank := func(pub *PublishedTrack) int {
+		if pub.kind == webrtc.RTPCodecTypeAudio && dominant != "" && pub.publisherID == dominant {
+			return -3
+		}
+		if pub.publisher != nil && pub.publisher.role == RoleHost {
+			if pub.media == mediaScreen {
+				return -2
+			}
+			return -1
+		}
+		if i, ok := order[pub.publisherID]; ok {
+			return i
+		}
+		return len(order)
+	}
+
+	r.mu.RLock()
+	for _, pub := range r.published {
+		switch {
+		case pub.kind == webrtc.RTPCodecTypeAudio:
+			if pub.media == mediaAudio {
+				audios = append(audios, pub)
+			}
+		case videoMime == "" || strings.EqualFold(pub.codec.MimeType, videoMime):
+			videos = append(videos, pub)
+		}
+	}
+	r.mu.RUnlock()
+
+	for _, list := range [][]*PublishedTrack{videos, audios} {
+		list := list
+		sort.Slice(list, func(i, j int) bool {
+			ri, rj := rank(list[i]), rank(list[j])
+			if ri != rj {
+				return ri < rj
+			}
+			return list[i].key < list[j].key
+		})
+	}
+	if len(videos) > videoSlots {
+		videos = videos[:videoSlots]
+	}
+	if len(audios) > audioSlots {
+		audios = audios[:audioSlots]
+	}
+	return videos, audios
+}
+
+func (v *whepViewer) run() {
+	v.selectSources()
+	ticker := time.NewTicker(whepSelectInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			v.selectSources()
+		case <-v.refresh:
+			v.selectSources()
+		case <-v.closed:
+			v.mu.Lock()
+			for _, slot := range v.slots {
+				if slot.source != nil {
+					slot.source.RemoveSubscriber(v.subID)
+					slot.source = nil
+				}
+			}
+			v.mu.Unlock()
+			v.room.removeViewer(v)
+			log.Printf("[ROOM %s] WHEP viewer %s left", v.room.id, v.id[:8])
+			return
+		}
+	}
+}
+
+// selectSources gives each slot its source. A source keeps its slot as
+// long as it is wanted, so that viewers do not see streams jump around.
+func (v *whepViewer) selectSources() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	var videoMime string
+	var videoSlots, audioSlots int
+	for _, slot := range v.slots {
+		if slot.kind == webrtc.RTPCodecTypeVideo {
+			videoMime = slot.mime
+			videoSlots++
+		} else {
+			audioSlots++
+		}
+	}
+	videos, audios := v.room.whepSources(videoMime, videoSlots, audioSlots)
+
+	for _, wanted := range [][]*PublishedTrack{videos, audios} {
+		assigned := map[*PublishedTrack]bool{}
+		for _, slot := range v.slots {
+			if slot.source != nil && containsTrack(wanted, slot.source) {
+				assigned[slot.source] = true
+			}
+		}
+		for _, slot := range v.slots {
+			if len(wanted) == 0 || slot.kind != wanted[0].kind {
+				continue
+			}
+			if slot.source != nil && assigned[slot.source] {
+				continue
+			}
+			var next *PublishedTrack
+			for _, pub := range wanted {
+				if !assigned[pub] {
+					next = pub
+					assigned[pub] = true
+					break
+				}
+			}
+			v.attachLocked(slot, next)
+		}
+	}
+	// Slots of a kind nobody publishes any more
+	if len(videos) == 0 || len(audios) == 0 {
+		for _, slot := range v.slots {
+			if slot.source == nil {
+				continue
+			}
+			if (slot.kind == webrtc.RTPCodecTypeVideo && len(videos) == 0) || (slot.kind == webrtc.RTPCodecTypeAudio && len(audios) == 0) {
+				v.attachLocked(slot, nil)
+			}
+		}
+	}
+}
+
+func (v *whepViewer) attachLocked(slot *whepSlot, next *PublishedTrack) {
+	if slot.source == next {
+		return
+	}
+	if slot.source != nil {
+		slot.source.RemoveSubscriber(v.subID)
+	}
+	slot.source = next
+	if next != nil {
+		slot.sink.switchSource()
+		next.AddSubscriber(v.subID, slot.sink, false)
+	}
+}
+
+// onConnectionStateChange closes the viewer when its PeerConnection is
+// closed, or when it stays disconnected or failed for
+// RoomConfig.ICEFailureTimeout (see ice_restart.go). WHEP has no
+// renegotiation to restart ICE with, so the viewer only waits for the
+// connection to come back by itself.
+func (v *whepViewer) onConnectionStateChange(state webrtc.PeerConnectionState) {
+	switch state {
+	case webrtc.PeerConnectionStateClosed:
+		v.Close()
+	case webrtc.PeerConnectionStateConnected:
+		v.iceMu.Lock()
+		defer v.iceMu.Unlock()
+		if v.iceFail != nil {
+			v.iceFail.Stop()
+			v.iceFail = nil
+			log.Printf("[ROOM %s] WHEP viewer %s connection recovered", v.room.id, v.id[:8])
+		}
+	case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed:
+		timeout := v.room.cfg.ICEFailureTimeout
+		if timeout <= 0 {
+			v.Close()
+			return
+		}
+		v.iceMu.Lock()
+		defer v.iceMu.Unlock()
+		if v.iceFail != nil {
+			return
+		}
+		log.Printf("[ROOM %s] WHEP viewer %s connection %s, closing in %s", v.room.id, v.id[:8], state, timeout)
+		var fail *time.Timer
+		fail = time.AfterFunc(timeout, func() {
+			v.iceMu.Lock()
+			down := v.iceFail == fail
+			v.iceMu.Unlock()
+			if down {
+				log.Printf("[ROOM %s] WHEP viewer %s connection not recovered", v.room.id, v.id[:8])
+				v.Close()
+			}
+		})
+		v.iceFail = fail
+	}
+}
+
+// readRTCP forwards the keyframe requests of the viewer to the current
+// source of slot.
+func (v *whepViewer) readRTCP(sender *webrtc.RTPSender, slot *whepSlot) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				v.mu.Lock()
+				source := slot.source
+				v.mu.Unlock()
+				if source != nil {
+					source.RequestKeyframe()
+				}
+			}
+		}
+	}
+}
+
+func (v *whepViewer) Close() {
+	v.closeOnce.Do(func() {
+		close(v.closed)
+		_ = v.pc.Close()
+	})
+}
+
+// addViewer registers a viewer, within RoomConfig.MaxViewers. The room
+// reference taken for it is released when it leaves.
+func (r *Room) addViewer(v *whepViewer) error {
+	r.mu.Lock()
+	if r.cfg.MaxViewers > 0 && len(r.viewers) >= r.cfg.MaxViewers {
+		r.mu.Unlock()
+		return ErrTooManyViewers
+	}
+	r.viewers[v.id] = v
+	count := len(r.viewers)
+	r.mu.Unlock()
+
+	r.BroadcastToAll(Signal{Type: "viewers", Count: count})
+	return nil
+}
+
+func (r *Room) removeViewer(v *whepViewer) {
+	r.mu.Lock()
+	if r.viewers[v.id] != v {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.viewers, v.id)
+	count := len(r.viewers)
+	r.mu.Unlock()
+
+	r.BroadcastToAll(Signal{Type: "viewers", Count: count})
+	r.Release()
+}
+
+// ViewerCount returns how many WHEP viewers watch the room.
+func (r *Room) ViewerCount() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.viewers)
+}
+
+func (r *Room) closeViewers() {
+	r.mu.RLock()
+	viewers := make([]*whepViewer, 0, len(r.viewers))
+	for _, v := range r.viewers {
+		viewers = append(viewers, v)
+	}
+	r.mu.RUnlock()
+
+	for _, v := range viewers {
+		v.Close()
+	}
+}
+
+// whepViewer returns the viewer viewerID of sessionID, if any.
+func (s *Server) whepViewer(sessionID, viewerID string) *whepViewer {
+	s.mu.RLock()
+	room := s.rooms[sessionID]
+	s.mu.RUnlock()
+	if room == nil {
+		return nil
+	}
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+	return room.viewers[viewerID]
+}
+
+func containsTrack(list []*PublishedTrack, pub *PublishedTrack) bool {
+	for _, other := range list {
+		if other == pub {
+			return true
+		}
+	}
+	return false
+}
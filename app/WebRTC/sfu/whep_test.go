@@ -0,0 +1,98 @@
+package sfu
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestWHEPAudioFollowsDominantSpeaker(t *testing.T) {
+	room := NewRoom("lesson-1", DefaultConfig().Rooms, func(*Room) {}, func(*Room) {})
+	host := &Peer{id: "host-peer-0001", role: RoleHost}
+	alice := &Peer{id: "alice-peer-0001", role: RoleStudent}
+	bob := &Peer{id: "bob-peer-00001", role: RoleStudent}
+	for _, peer := range []*Peer{host, alice, bob} {
+		pub := &PublishedTrack{
+			key:         peer.id + ":audio",
+			publisherID: peer.id,
+			publisher:   peer,
+			kind:        webrtc.RTPCodecTypeAudio,
+			media:       mediaAudio,
+		}
+		room.published[pub.key] = pub
+		room.addSpeaker(peer.id)
+	}
+
+	audioOf := func(slots int) []string {
+		_, audios := room.whepSources("", 0, slots)
+		ids := make([]string, len(audios))
+		for i, pub := range audios {
+			ids[i] = pub.publisherID
+		}
+		return ids
+	}
+
+	// Nobody spoke yet: the host
+	if got := audioOf(1); len(got) != 1 || got[0] != host.id {
+		t.Fatalf("before anyone spoke: %v, want the host", got)
+	}
+
+	room.speakerMu.Lock()
+	room.speakers = []string{bob.id, host.id, alice.id}
+	room.dominant = bob.id
+	room.speakerMu.Unlock()
+
+	if got := audioOf(1); len(got) != 1 || got[0] != bob.id {
+		t.Fatalf("single slot: %v, want the dominant speaker", got)
+	}
+	if got := audioOf(3); len(got) != 3 || got[0] != bob.id || got[1] != host.id || got[2] != alice.id {
+		t.Fatalf("three slots: %v, want dominant, host, then the others", got)
+	}
+}
+
+func TestWHEPViewerICEGrace(t *testing.T) {
+	newViewer := func(t *testing.T, timeout time.Duration) *whepViewer {
+		cfg := DefaultConfig().Rooms
+		cfg.ICEFailureTimeout = timeout
+		pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		room := NewRoom("lesson-1", cfg, func(*Room) {}, func(*Room) {})
+		return &whepViewer{id: "viewer-00000001", room: room, pc: pc, closed: make(chan struct{})}
+	}
+	isClosed := func(v *whepViewer) bool {
+		select {
+		case <-v.closed:
+			return true
+		default:
+			return false
+		}
+	}
+
+	v := newViewer(t, 100*time.Millisecond)
+	v.onConnectionStateChange(webrtc.PeerConnectionStateDisconnected)
+	v.onConnectionStateChange(webrtc.PeerConnectionStateFailed)
+	if isClosed(v) {
+		t.Fatal("closed as soon as the connection went down")
+	}
+	v.onConnectionStateChange(webrtc.PeerConnectionStateConnected)
+	time.Sleep(200 * time.Millisecond)
+	if isClosed(v) {
+		t.Fatal("closed after the connection came back")
+	}
+
+	v.onConnectionStateChange(webrtc.PeerConnectionStateFailed)
+	select {
+	case <-v.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not closed after ICEFailureTimeout")
+	}
+
+	v = newViewer(t, 0)
+	v.onConnectionStateChange(webrtc.PeerConnectionStateDisconnected)
+	if !isClosed(v) {
+		t.Fatal("not closed at once without ICEFailureTimeout")
+	}
+}
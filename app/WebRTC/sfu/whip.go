@@ -0,0 +1,276 @@
+package sfu
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v3"
+)
+
+// WHIP ingest (RFC 9725) lets encoders such as OBS publish into a room:
+//
+//	POST   /whip/{sessionId}                   SDP offer -> 201 + answer, Location
+//	PATCH  /whip/{sessionId}/{peerId}/{secret} trickle ICE candidates
+//	DELETE /whip/{sessionId}/{peerId}/{secret} leave
+//
+// The bearer token is the same join token the WebSocket clients send (or
+// the access token for the authorizer when tokens are disabled). The
+// resource URL in Location carries a random secret: every participant
+// learns the peer ID from peer_joined, but only the encoder knows the
+// secret, so nobody else can end or tamper with its session. The
+// encoder becomes a publish-only peer: it has no signaling channel and
+// subscribes to nothing, but the room sees a normal peer_joined and its
+// tracks go through Room.AddPublishedTrack.
+const (
+	whipPathPrefix    = "/whip/"
+	whipMaxBody       = 64 * 1024
+	whipGatherTimeout = 5 * time.Second
+)
+
+var errPublishOnly = errors.New("publish-only peer")
+
+// HandleWHIP serves the WHIP endpoint and its resources under /whip/.
+func (s *Server) HandleWHIP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Link")
+
+	parts, ok := resourcePath(r, whipPathPrefix)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case r.Method == http.MethodOptions:
+		w.Header().Set("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.Header().Set("Accept-Post", "application/sdp")
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 1 && parts[0] != "" && r.Method == http.MethodPost:
+		s.whipPublish(w, r, parts[0])
+	case len(parts) == 3 && r.Method == http.MethodPatch:
+		s.whipTrickle(w, r, parts[0], parts[1], parts[2])
+	case len(parts) == 3 && r.Method == http.MethodDelete:
+		peer := s.whipPeer(parts[0], parts[1], parts[2])
+		if peer == nil {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("[PEER %s] WHIP session deleted", peer.id[:8])
+		peer.Close()
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) whipPublish(w http.ResponseWriter, r *http.Request, sessionID string) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+		http.Error(w, "expected application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+	offer, err := io.ReadAll(io.LimitReader(r.Body, whipMaxBody))
+	if err != nil || len(offer) == 0 {
+		http.Error(w, "invalid offer", http.StatusBadRequest)
+		return
+	}
+
+	join, role, lessonEnd, err := s.identifyHTTP(r, sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), identifyStatus(err))
+		return
+	}
+	if role == RoleObserver {
+		http.Error(w, "not allowed to publish", http.StatusForbidden)
+		return
+	}
+
+	room := s.getOrCreateRoom(join.SessionID)
+	release := true
+	defer func() {
+		if release {
+			room.Release()
+		}
+	}()
+
+	switch {
+	case lessonEnd != 0 && !room.LimitUntil(time.Unix(lessonEnd, 0)):
+		http.Error(w, "room closed", http.StatusForbidden)
+		return
+	case room.IsBanned(join.UserID):
+		log.Printf("banned user=%s tried to publish over WHIP session=%s", join.UserID, join.SessionID)
+		http.Error(w, "banned", http.StatusForbidden)
+		return
+	case room.UsesLobby(role):
+		http.Error(w, "the lobby is not supported over WHIP", http.StatusForbidden)
+		return
+	case room.IsFull(role):
+		http.Error(w, ErrRoomFull.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	peerID := uuid.NewString()
+	peer, err := NewPeer(peerID, join.UserID, join.UserName, role, !s.cfg.StudentsMuted, !s.cfg.StudentsAudioOnly, room, nil, s.api)
+	if err != nil {
+		http.Error(w, "peer setup failed", http.StatusInternalServerError)
+		return
+	}
+	answer, err := peer.answerWHIP(string(offer))
+	if err != nil {
+		log.Printf("[PEER %s] WHIP offer rejected: %v", peerID[:8], err)
+		peer.Close()
+		http.Error(w, "invalid offer", http.StatusBadRequest)
+		return
+	}
+	if err := room.Join(peer); err != nil {
+		peer.Close()
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	log.Printf("peer connected over WHIP user=%s session=%s peer=%s role=%s", join.UserID, join.SessionID, peerID, role)
+	peer.Start()
+	release = false
+	go func() {
+		<-peer.Done()
+		room.RemovePeer(peerID)
+		room.Release()
+		log.Printf("peer disconnected over WHIP user=%s session=%s peer=%s", join.UserID, join.SessionID, peerID)
+	}()
+
+	for _, link := range iceLinkHeaders(room.cfg.ICE.serversFor(join.UserID, time.Now())) {
+		w.Header().Add("Link", link)
+	}
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", whipPathPrefix+url.PathEscape(sessionID)+"/"+peerID+"/"+peer.whipSecret)
+	w.WriteHeader(http.StatusCreated)
+	_, _ = io.WriteString(w, answer)
+}
+
+// answerWHIP answers the offer of an encoder. WHIP clients may not trickle,
+// so the answer carries every server candidate.
+func (p *Peer) answerWHIP(sdp string) (string, error) {
+	if err := p.pubPC.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}); err != nil {
+		return "", err
+	}
+	answer, err := p.pubPC.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	gathered := webrtc.GatheringCompletePromise(p.pubPC)
+	if err := p.pubPC.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	select {
+	case <-gathered:
+	case <-time.After(whipGatherTimeout):
+	}
+	return p.pubPC.LocalDescription().SDP, nil
+}
+
+// whipTrickle adds the candidates of a trickle-ice-sdpfrag (RFC 8840).
+// ICE restarts are not supported.
+func (s *Server) whipTrickle(w http.ResponseWriter, r *http.Request, sessionID, peerID, secret string) {
+	peer := s.whipPeer(sessionID, peerID, secret)
+	if peer == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/trickle-ice-sdpfrag") {
+		http.Error(w, "expected application/trickle-ice-sdpfrag", http.StatusUnsupportedMediaType)
+		return
+	}
+	frag, err := io.ReadAll(io.LimitReader(r.Body, whipMaxBody))
+	if err != nil {
+		http.Error(w, "invalid sdpfrag", http.StatusBadRequest)
+		return
+	}
+	if err := addTrickleCandidates(peer.pubPC, string(frag)); err != nil {
+		log.Printf("[PEER %s] WHIP candidate rejected: %v", peer.id[:8], err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// addTrickleCandidates adds the candidates of a trickle-ice-sdpfrag
+// (RFC 8840) to pc. The last error is returned.
+func addTrickleCandidates(pc *webrtc.PeerConnection, frag string) error {
+	var mid string
+	var lastErr error
+	for _, line := range strings.Split(frag, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidate := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a=")}
+			if mid != "" {
+				candidate.SDPMid = &mid
+			}
+			if err := pc.AddICECandidate(candidate); err != nil {
+				lastErr = err
+			}
+		}
+	}
+	return lastErr
+}
+
+// resourcePath splits the unescaped path segments after prefix.
+func resourcePath(r *http.Request, prefix string) ([]string, bool) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), prefix), "/")
+	for i, part := range parts {
+		unescaped, err := url.PathUnescape(part)
+		if err != nil {
+			return nil, false
+		}
+		parts[i] = unescaped
+	}
+	return parts, true
+}
+
+// identifyHTTP runs identify for a WHIP or WHEP request: the bearer token
+// takes the place of the join token.
+func (s *Server) identifyHTTP(r *http.Request, sessionID string) (Signal, Role, int64, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	join := Signal{SessionID: sessionID, Token: token, AccessToken: token}
+	if s.tokens == nil {
+		// Without tokens the identity is client-supplied, as over /ws
+		join.UserID = r.URL.Query().Get("userId")
+		join.UserName = r.URL.Query().Get("userName")
+	}
+	role, lessonEnd, err := s.identify(&join)
+	return join, role, lessonEnd, err
+}
+
+// whipPeer returns the WHIP publisher peerID of sessionID, if any and if
+// secret is the one of its resource URL.
+func (s *Server) whipPeer(sessionID, peerID, secret string) *Peer {
+	s.mu.RLock()
+	room := s.rooms[sessionID]
+	s.mu.RUnlock()
+	if room == nil {
+		return nil
+	}
+	peer := room.GetPeer(peerID)
+	if peer == nil || peer.subPC != nil || subtle.ConstantTimeCompare([]byte(secret), []byte(peer.whipSecret)) != 1 {
+		return nil
+	}
+	return peer
+}
+
+func identifyStatus(err error) int {
+	switch {
+	case errors.Is(err, errInvalidJoin):
+		return http.StatusBadRequest
+	case errors.Is(err, errAccessDenied):
+		return http.StatusForbidden
+	case errors.Is(err, errAuthorizationFailed):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusUnauthorized
+}
@@ -38,6 +38,13 @@
     'stripe' => [
         'sk' => env('STRIPE_SK_KEY'),
         'pk' => env('STRIPE_PK_KEY'),
-    ]
+    ],
+
+    'sfu' => [
+        'token_secret' => env('SFU_JOIN_TOKEN_SECRET'),
+        'token_ttl' => env('SFU_JOIN_TOKEN_TTL', 60),
+        'lesson_duration' => env('SFU_LESSON_DURATION', 120), // minutes after lesson date
+        'export_secret' => env('SFU_CHAT_EXPORT_SECRET'), // signs the chat log export, not the join tokens
+    ],
 
 ];
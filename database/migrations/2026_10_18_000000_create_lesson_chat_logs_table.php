@@ -0,0 +1,35 @@
+<?php
+
+use Illuminate\Database\Migrations\Migration;
+use Illuminate\Database\Schema\Blueprint;
+use Illuminate\Support\Facades\Schema;
+
+return new class extends Migration
+{
+    /**
+     * Run the migrations.
+     */
+    public function up(): void
+    {
+        Schema::create('lesson_chat_logs', function (Blueprint $table) {
+            $table->id();
+            $table->foreignId("lesson_id")->constrained("lessons");
+            $table->dateTime("started_at");
+            $table->dateTime("closed_at");
+            $table->json("messages");
+            $table->unsignedInteger("dropped")->default(0);
+            $table->timestamps();
+
+            /* One log per opening of the lesson's room; the SFU may retry an export */
+            $table->unique(["lesson_id", "started_at"]);
+        });
+    }
+
+    /**
+     * Reverse the migrations.
+     */
+    public function down(): void
+    {
+        Schema::dropIfExists('lesson_chat_logs');
+    }
+};
@@ -26,6 +26,7 @@ export class WebRTCClient extends EventTarget {
 		this.url = options.url;
 		this.userId = options.userId;
 		this.userName = options.userName; // Set userName
+		this.token = options.token || null; // Join token string or async () => string
 		this.sessionId = options.sessionId;
 
 		// State (readable pero no writable desde outside)
@@ -61,6 +62,10 @@ export class WebRTCClient extends EventTarget {
 		this.subOfferQueue = [];
 		this.processingSubOffer = false;
 		this.audioContext = null;
+		this.dataChannels = new Map(); // label -> RTCDataChannel, abiertos por el servidor
+		this.resumeToken = null; // para recuperar el mismo peer si se cae el WebSocket
+		this.resumeGrace = 0;
+		this.resumePeers = null; // peers conocidos antes de reanudar
 
 		// Optional legacy callbacks (para backward compatibility)
 		this.onTrack = options.onTrack || null;
@@ -118,7 +123,7 @@ export class WebRTCClient extends EventTarget {
 			});
 
 			this.ws.onmessage = (event) => this.handleMessage(event);
-			this.ws.onclose = () => this._handleDisconnect();
+			this.ws.onclose = () => this._onSocketClose();
 
 			this.initPubPC();
 			this.initSubPC();
@@ -127,11 +132,14 @@ export class WebRTCClient extends EventTarget {
 			this._emit('authorizing');
 			if (this.onAuthorizing) this.onAuthorizing();
 
+			const token = typeof this.token === 'function' ? await this.token() : this.token;
+
 			this.send({
 				type: "join",
 				userId: this.userId,
 				userName: this.userName, // Send userName
 				sessionId: this.sessionId,
+				token: token || undefined,
 			});
 		} catch (error) {
 			this._setState({ connectionState: 'failed' });
@@ -156,6 +164,7 @@ export class WebRTCClient extends EventTarget {
 		if (this.subPC) {
 			this.subPC.close();
 		}
+		this.resumeToken = null;
 		if (this.ws) {
 			this.ws.close();
 		}
@@ -163,6 +172,77 @@ export class WebRTCClient extends EventTarget {
 		this._handleDisconnect();
 	}
 
+	// STUN/TURN del servidor (credenciales TURN temporales), antes de reunir candidatos
+	_setIceServers(iceServers) {
+		if (!iceServers || iceServers.length === 0) {
+			return;
+		}
+		for (const pc of [this.pubPC, this.subPC]) {
+			if (pc) {
+				pc.setConfiguration({ ...pc.getConfiguration(), iceServers });
+			}
+		}
+	}
+
+	_onSocketClose() {
+		if (this.resumeToken) {
+			this._resume();
+		} else {
+			this._handleDisconnect();
+		}
+	}
+
+	// Reconecta el WebSocket y recupera el mismo peer mientras el servidor lo guarde
+	async _resume() {
+		const deadline = Date.now() + this.resumeGrace;
+		this._setState({ connectionState: 'reconnecting' });
+		this._emit('reconnecting');
+		while (this.resumeToken && Date.now() < deadline) {
+			try {
+				const ws = new WebSocket(this.url);
+				await new Promise((resolve, reject) => {
+					ws.onopen = resolve;
+					ws.onerror = reject;
+				});
+				if (!this.resumeToken) {
+					ws.close();
+					return;
+				}
+				this.ws = ws;
+				ws.onmessage = (event) => this.handleMessage(event);
+				ws.onclose = () => this._onSocketClose();
+				this.send({
+					type: "resume",
+					sessionId: this.sessionId,
+					peerId: this._state.peerId,
+					resumeToken: this.resumeToken,
+				});
+				return;
+			} catch {
+				await new Promise((resolve) => setTimeout(resolve, 1000));
+			}
+		}
+		this.resumeToken = null;
+		this._handleDisconnect();
+	}
+
+	async _onResumed(msg) {
+		this.resumeToken = msg.resumeToken;
+		this.resumePeers = new Set(this._state.peers.keys());
+		this._setIceServers(msg.iceServers);
+		this._setState({ connected: true, connectionState: 'connected' });
+		this.send({ type: "sub_ready" });
+		// Reinicia ICE del pubPC; el servidor reinicia el del subPC con el siguiente sub_offer
+		if (this.pubPC) {
+			if (this.pubPC.signalingState === "have-local-offer") {
+				await this.pubPC.setLocalDescription({ type: "rollback" });
+			}
+			this.pubPC.restartIce();
+			await this.negotiatePub();
+		}
+		this._emit('resumed', { peerId: msg.peerId });
+	}
+
 	async startScreenShare() {
 		if (!this.pubPC) {
 			throw new Error("not connected");
@@ -308,6 +388,87 @@ export class WebRTCClient extends EventTarget {
 	// Internal Methods / Privados
 	// ========================
 
+	pinPeer(peerId) {
+		this.send({ type: "pin", peerId });
+	}
+
+	unpinPeer(peerId) {
+		this.send({ type: "unpin", peerId });
+	}
+
+	startRecording() {
+		this.send({ type: "start_recording" });
+	}
+
+	stopRecording() {
+		this.send({ type: "stop_recording" });
+	}
+
+	startEgress(egress, url) {
+		this.send({ type: "start_egress", egress, url });
+	}
+
+	stopEgress(egressId) {
+		this.send({ type: "stop_egress", egressId });
+	}
+
+	sendChat(text) {
+		return this._sendData("reliable", { type: "chat", text });
+	}
+
+	sendReaction(emoji) {
+		return this._sendData("lossy", { type: "reaction", emoji });
+	}
+
+	raiseHand(raised = true) {
+		// Sin canal de datos la cola de manos también acepta la señalización
+		if (!this._sendData("reliable", { type: "hand", raised })) {
+			this.send({ type: raised ? "raise_hand" : "lower_hand" });
+		}
+	}
+
+	callOn(peerId) {
+		this.send({ type: "call_on", peerId });
+	}
+
+	dismiss(peerId) {
+		this.send({ type: "dismiss", peerId });
+	}
+
+	_sendData(label, msg) {
+		const channel = this.dataChannels.get(label);
+		if (!channel || channel.readyState !== "open") {
+			return false;
+		}
+		channel.send(JSON.stringify(msg));
+		return true;
+	}
+
+	_handleDataMessage(event) {
+		let msg;
+		try {
+			msg = JSON.parse(event.data);
+		} catch {
+			return;
+		}
+		switch (msg.type) {
+		case "chat":
+			this._emit('chat', { id: msg.id, from: msg.from, at: msg.at, text: msg.text });
+			return;
+		case "reaction":
+			this._emit('reaction', { id: msg.id, from: msg.from, at: msg.at, emoji: msg.emoji });
+			return;
+		case "hand":
+			this._emit('hand', { id: msg.id, from: msg.from, at: msg.at, raised: !!msg.raised });
+			return;
+		case "error":
+			this._emit('data-error', { message: msg.message });
+			return;
+		default:
+			return;
+		}
+	}
+
 	_setState(updates) {
 		this._state = { ...this._state, ...updates };
 		this._emit('state-change', { state: { ...this._state } });
@@ -346,17 +507,42 @@ export class WebRTCClient extends EventTarget {
 				peerId: msg.peerId,
 				connectionState: 'connected'
 			});
+			this.resumeToken = msg.resumeToken || null;
+			this.resumeGrace = msg.resumeGrace || 0;
+			this._setIceServers(msg.iceServers);
 			// Emit connected event
 			this._emit('connected', { peerId: msg.peerId });
 			this.send({ type: "sub_ready" });
 			await this.startLocalMedia();
 			return;
+		case "resumed":
+			await this._onResumed(msg);
+			return;
+		case "ice_restart":
+			// El servidor perdió la conexión del pubPC; el del subPC lo reinicia él
+			if (msg.target === "pub" && this.pubPC) {
+				this.pubPC.restartIce();
+				await this.negotiatePub();
+			}
+			this._emit('ice-restart', { target: msg.target });
+			return;
 		case "peer_list":
 			{
 				const users = msg.users || [];
+				if (this.resumePeers) {
+					// Los que se fueron mientras estábamos desconectados
+					users.forEach(u => this.resumePeers.delete(u.peerId));
+					this.resumePeers.forEach(peerId => {
+						this._state.peers.delete(peerId);
+						this._emit('peer-left', { peerId });
+						if (this.onPeerLeft) this.onPeerLeft(peerId);
+					});
+					this.resumePeers = null;
+				}
 				users.forEach(u => this._state.peers.set(u.peerId, u));
 				this._emit('peer-list', { peers: users });
 				if (this.onPeerList) this.onPeerList(users);
+				this._emit('hand-queue', { hands: msg.hands || [] });
 			}
 			return;
 		case "peer_joined":
@@ -386,7 +572,10 @@ export class WebRTCClient extends EventTarget {
 			return;
 		case "error":
 			console.error("[CLIENT] Error from server:", msg.message);
-			if (msg.message === "access denied" || msg.message === "authorization failed") {
+			if (msg.message === "resume failed") {
+				this.resumeToken = null;
+			}
+			if (["access denied", "authorization failed", "token required", "invalid token", "token expired", "token session mismatch"].includes(msg.message)) {
 				this._emit('authorization-failed', { reason: msg.message });
 				if (this.onAuthorizationFailed) this.onAuthorizationFailed(msg.message);
 			}
@@ -450,6 +639,34 @@ export class WebRTCClient extends EventTarget {
 				if (this.onScreenStream) this.onScreenStream(screenInfo);
 			}
 			return;
+		case "dominant_speaker":
+			this._emit('dominant-speaker', { peerId: msg.peerId, userId: msg.userId });
+			return;
+		case "video_paused":
+		case "video_resumed":
+			this._emit(msg.type === "video_paused" ? 'video-paused' : 'video-resumed', { peerId: msg.peerId, streamId: msg.streamId });
+			return;
+		case "recording_started":
+		case "recording_stopped":
+			this._emit('recording', { recording: msg.type === "recording_started", peerId: msg.peerId });
+			return;
+		case "viewers":
+			this._emit('viewers', { count: msg.count || 0 });
+			return;
+		case "hand_queue":
+			this._emit('hand-queue', { hands: msg.hands || [] });
+			return;
+		case "permissions":
+			this._emit('permissions', { peerId: msg.peerId, audioAllowed: !!msg.audioAllowed, videoAllowed: !!msg.videoAllowed });
+			return;
+		case "chat_history":
+			// Mensajes anteriores a nuestra llegada, mismo formato que los del canal de datos
+			this._emit('chat-history', { messages: msg.messages || [] });
+			return;
+		case "egress_started":
+		case "egress_stopped":
+			this._emit('egress', { live: msg.type === "egress_started", egressId: msg.egressId, egress: msg.egress, url: msg.url, error: msg.message });
+			return;
 		default:
 			return;
 		}
@@ -512,6 +729,18 @@ export class WebRTCClient extends EventTarget {
 			this.emitState(this.subPC.connectionState);
 		};
 
+		// Chat, reacciones y manos: canales "reliable" y "lossy" abiertos por el servidor
+		this.subPC.ondatachannel = (event) => {
+			const channel = event.channel;
+			this.dataChannels.set(channel.label, channel);
+			channel.onmessage = (e) => this._handleDataMessage(e);
+			channel.onclose = () => {
+				if (this.dataChannels.get(channel.label) === channel) {
+					this.dataChannels.delete(channel.label);
+				}
+			};
+		};
+
 		this.subPC.ontrack = (event) => {
 			const streams = event.streams && event.streams.length > 0
 				? event.streams
@@ -1,4 +1,5 @@
 import { useState, useEffect, useCallback } from 'react';
+import axios from 'axios';
 // @ts-expect-error
 import { WebRTCClient } from '@/lib/webrtc-client';
 import Alert from '@/components/Alert';
@@ -44,6 +45,17 @@ export function useWebRTCConnection({ userId, userName, sessionId }: UseWebRTCCo
       userId,
       userName,
       sessionId,
+      // Fetched right before `join` so the short-lived token is still valid
+      token: async () => {
+        try {
+          const { data } = await axios.post(`/api/video-call/${sessionId}/token`);
+          return data.token;
+        } catch (err: any) {
+          // 503: tokens not configured (development), join without one
+          if (err?.response?.status === 503) return null;
+          throw err;
+        }
+      },
     });
 
     // Set client immediately
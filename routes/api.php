@@ -14,9 +14,16 @@
 Route::post("/auth/reset-password", [PasswordResetController::class, 'resetPassword']);
 Route::post("/auth/verify-token", [PasswordResetController::class, 'verifyToken']);
 
+/* Chat log exported by the SFU when a lesson's room closes (signed with the SFU secret) */
+Route::post("/video-call/{lesson}/chat-log", [User\VideoCall::class, 'chatLog']);
+
 Route::middleware('auth:sanctum')->group(function () {
 
     Route::get("/user", [AuthController::class, 'me']);
+
+    /* Video call join token (students, professors and administrators) */
+    Route::post("/video-call/{lesson}/token", [User\VideoCall::class, 'token']);
+    Route::get("/video-call/{lesson}/introspect", [User\VideoCall::class, 'introspect']);
     
     /* Admin routes */
     Route::prefix('admin')->middleware('role:administrator')->group(function () {